@@ -2,11 +2,20 @@ package repository
 
 import (
 	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/mkideal/pkg/debug"
+
+	"github.com/mkideal/cmail/smtpd/server"
 )
 
 const (
@@ -17,32 +26,59 @@ const (
 	sqlCreateTableEmail = "CREATE TABLE IF NOT EXISTS email (" +
 		"`id` INT NOT NULL AUTO_INCREMENT," +
 		"`username` varchar(64) NOT NULL," +
-		"`from` varchar(64) NOT NULL," +
+		"`from` varchar(256) NOT NULL," +
 		"`tos` text NOT NULL," +
-		"`data` blob," +
+		"`body` varchar(16) NOT NULL DEFAULT '7BIT'," +
+		"`smtputf8` tinyint(1) NOT NULL DEFAULT 0," +
+		"`ret` varchar(8) NOT NULL DEFAULT ''," +
+		"`envid` varchar(100) NOT NULL DEFAULT ''," +
+		"`notify` varchar(32) NOT NULL DEFAULT ''," +
+		"`orcpt` varchar(500) NOT NULL DEFAULT ''," +
+		"`path` varchar(255) NOT NULL," +
 		"PRIMARY KEY ( id )" +
-		"FOREIGN KEY ( username ) REFERENCES mailbox ( username )" +
 		")"
 
 	sqlCreateTableMailbox = "CREATE TABLE IF NOT EXISTS mailbox(" +
 		"`id` INT NOT NULL AUTO_INCREMENT," +
 		"`username` varchar(64) NOT NULL," +
 		"`address` varchar(64) NOT NULL," +
+		"`password` varchar(128) NOT NULL DEFAULT ''," +
+		"`salt` varbinary(64) NOT NULL DEFAULT ''," +
+		"`iterations` INT NOT NULL DEFAULT 0," +
+		"`stored_key` varbinary(64) NOT NULL DEFAULT ''," +
+		"`server_key` varbinary(64) NOT NULL DEFAULT ''," +
 		"`create_date` varchar(32) NOT NULL," +
 		"PRIMARY KEY ( id )" +
 		") ENGINE=InnoDB DEFAULT CHARSET=utf8"
 
 	sqlFindMailbox = `SELECT username,address FROM mailbox WHERE username=? OR address=?`
 
-	sqlSaveEmail = "INSERT INTO email(`account`,`from`,`tos`,`data`) values(?,?,?,?)"
+	sqlFindCredential = `SELECT username,address,password,salt,iterations,stored_key,server_key FROM mailbox WHERE username=? OR address=?`
+
+	sqlFindColumn = `SELECT CHARACTER_MAXIMUM_LENGTH FROM information_schema.COLUMNS WHERE TABLE_SCHEMA='smtpd' AND TABLE_NAME=? AND COLUMN_NAME=?`
+
+	sqlFindPlaintextPasswords = `SELECT id,password FROM mailbox WHERE password<>'' AND iterations=0`
+
+	sqlSetPassword = `UPDATE mailbox SET salt=?,iterations=?,stored_key=?,server_key=? WHERE id=?`
+
+	sqlSetUserPassword = `UPDATE mailbox SET salt=?,iterations=?,stored_key=?,server_key=?,password=? WHERE username=?`
+
+	sqlClearPlaintextPasswords = `UPDATE mailbox SET password='' WHERE password<>'' AND iterations>0`
+
+	sqlSaveEmail = "INSERT INTO email(`username`,`from`,`tos`,`body`,`smtputf8`,`ret`,`envid`,`notify`,`orcpt`,`path`) values(?,?,?,?,?,?,?,?,?,?)"
 )
 
 type MysqlRepository struct {
-	locker sync.Mutex
-	db     *sql.DB
+	locker    sync.Mutex
+	db        *sql.DB
+	mailDir   string
+	plaintext bool
 }
 
-func Mysql(dbsource string) (*MysqlRepository, error) {
+// Mysql creates a repository which stores metadata of emails in mysql,
+// and mail data in files under mailDir. Plaintext passwords are kept for
+// CRAM-MD5 if plaintext is true, otherwise they are cleared.
+func Mysql(dbsource, mailDir string, plaintext bool) (*MysqlRepository, error) {
 	db, err := sql.Open("mysql", dbsource)
 	if err != nil {
 		return nil, err
@@ -50,17 +86,146 @@ func Mysql(dbsource string) (*MysqlRepository, error) {
 
 	repo := new(MysqlRepository)
 	repo.db = db
+	repo.mailDir = mailDir
+	repo.plaintext = plaintext
 	if err := multiExec(db,
 		sqlCreateDatabase,
 		sqlUseDatabase,
-		sqlCreateTableEmail,
 		sqlCreateTableMailbox,
+		sqlCreateTableEmail,
 	); err != nil {
 		return nil, err
 	}
+	if err := repo.migrate(); err != nil {
+		return nil, err
+	}
 	return repo, nil
 }
 
+// addedColumn is a column added to a table after the table is created by
+// old versions, it's added by migrate if missing
+type addedColumn struct {
+	table      string
+	name       string
+	definition string
+}
+
+var addedColumns = []addedColumn{
+	{"mailbox", "password", "varchar(128) NOT NULL DEFAULT ''"},
+	{"mailbox", "salt", "varbinary(64) NOT NULL DEFAULT ''"},
+	{"mailbox", "iterations", "INT NOT NULL DEFAULT 0"},
+	{"mailbox", "stored_key", "varbinary(64) NOT NULL DEFAULT ''"},
+	{"mailbox", "server_key", "varbinary(64) NOT NULL DEFAULT ''"},
+	{"email", "body", "varchar(16) NOT NULL DEFAULT '7BIT'"},
+	{"email", "smtputf8", "tinyint(1) NOT NULL DEFAULT 0"},
+	{"email", "ret", "varchar(8) NOT NULL DEFAULT ''"},
+	{"email", "envid", "varchar(100) NOT NULL DEFAULT ''"},
+	{"email", "notify", "varchar(32) NOT NULL DEFAULT ''"},
+	{"email", "orcpt", "varchar(500) NOT NULL DEFAULT ''"},
+	{"email", "path", "varchar(255) NOT NULL DEFAULT ''"},
+}
+
+// widenedColumn is a column whose length is extended after the table is
+// created by old versions, it's modified by migrate if shorter
+type widenedColumn struct {
+	table      string
+	name       string
+	length     int64
+	definition string
+}
+
+var widenedColumns = []widenedColumn{
+	{"email", "from", 256, "varchar(256) NOT NULL"},
+	{"email", "orcpt", 500, "varchar(500) NOT NULL DEFAULT ''"},
+}
+
+// migrationStatements returns statements adding columns which don't exist,
+// and widening columns which are shorter. find reports whether a column
+// exists and its maximum length in characters.
+func migrationStatements(find func(table, column string) (bool, int64, error)) ([]string, error) {
+	var stmts []string
+	for _, column := range addedColumns {
+		ok, _, err := find(column.table, column.name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			stmts = append(stmts, "ALTER TABLE "+column.table+" ADD COLUMN `"+column.name+"` "+column.definition)
+		}
+	}
+	for _, column := range widenedColumns {
+		ok, length, err := find(column.table, column.name)
+		if err != nil {
+			return nil, err
+		}
+		if ok && length < column.length {
+			stmts = append(stmts, "ALTER TABLE "+column.table+" MODIFY COLUMN `"+column.name+"` "+column.definition)
+		}
+	}
+	return stmts, nil
+}
+
+// migrate adds missing columns to tables created by old versions, widens
+// short columns, and hashes plaintext passwords which have no SCRAM keys.
+// Plaintext passwords are cleared then if not kept.
+func (repo *MysqlRepository) migrate() error {
+	stmts, err := migrationStatements(func(table, column string) (bool, int64, error) {
+		var length sql.NullInt64
+		err := repo.db.QueryRow(sqlFindColumn, table, column).Scan(&length)
+		if err == sql.ErrNoRows {
+			return false, 0, nil
+		}
+		return err == nil, length.Int64, err
+	})
+	if err != nil {
+		return err
+	}
+	if err := multiExec(repo.db, stmts...); err != nil {
+		return err
+	}
+
+	rows, err := repo.db.Query(sqlFindPlaintextPasswords)
+	if err != nil {
+		return err
+	}
+	passwords := make(map[int64]string)
+	for rows.Next() {
+		var (
+			id       int64
+			password string
+		)
+		if err := rows.Scan(&id, &password); err != nil {
+			rows.Close()
+			return err
+		}
+		passwords[id] = password
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, password := range passwords {
+		cred := server.NewCredential(nil, password)
+		if _, err := repo.db.Exec(sqlSetPassword, cred.Salt, cred.Iterations, cred.StoredKey, cred.ServerKey, id); err != nil {
+			return err
+		}
+	}
+	if len(passwords) > 0 {
+		debug.Debugf("%d plaintext passwords hashed", len(passwords))
+	}
+	if repo.plaintext {
+		return nil
+	}
+	result, err := repo.db.Exec(sqlClearPlaintextPasswords)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		debug.Debugf("%d plaintext passwords cleared", n)
+	}
+	return nil
+}
+
 func (repo *MysqlRepository) FindMailbox(usernameOrAddress string) (*mail.Address, bool) {
 	rows, err := repo.db.Query(sqlFindMailbox, usernameOrAddress, usernameOrAddress)
 	if err != nil {
@@ -78,22 +243,123 @@ func (repo *MysqlRepository) FindMailbox(usernameOrAddress string) (*mail.Addres
 	return nil, false
 }
 
-func (repo *MysqlRepository) SaveEmail(addr *mail.Address, from, tos string, data []byte) error {
-	if data == nil {
-		data = []byte{}
+// findCredential returns credential of mailbox including plaintext password
+func (repo *MysqlRepository) findCredential(username string) (*server.Credential, error) {
+	rows, err := repo.db.Query(sqlFindCredential, username, username)
+	if err != nil {
+		debug.Debugf("Query %q error: %v", sqlFindCredential, err)
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, server.ErrAuthFailed
+	}
+	cred := &server.Credential{Mailbox: &mail.Address{}}
+	if err := rows.Scan(&cred.Mailbox.Name, &cred.Mailbox.Address, &cred.Password,
+		&cred.Salt, &cred.Iterations, &cred.StoredKey, &cred.ServerKey); err != nil {
+		debug.Debugf("Scan result error: %v", err)
+		return nil, err
+	}
+	return cred, nil
+}
+
+// Authenticate verifies password by SCRAM keys of the mailbox, which are
+// derived from password by PBKDF2, the password itself isn't compared
+func (repo *MysqlRepository) Authenticate(username, password string) (*mail.Address, error) {
+	cred, err := repo.findCredential(username)
+	if err != nil {
+		return nil, err
+	}
+	if !cred.VerifyPassword(password) {
+		return nil, server.ErrAuthFailed
+	}
+	return cred.Mailbox, nil
+}
+
+// SetPassword stores SCRAM keys derived from password of user, and the
+// plaintext password if kept
+func (repo *MysqlRepository) SetPassword(username, password string) error {
+	cred := server.NewCredential(nil, password)
+	if repo.plaintext {
+		cred.Password = password
+	}
+	result, err := repo.db.Exec(sqlSetUserPassword, cred.Salt, cred.Iterations, cred.StoredKey, cred.ServerKey, cred.Password, username)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("mailbox %s not found", username)
+	}
+	return nil
+}
+
+// LookupCredential returns SCRAM keys of the mailbox, and the plaintext
+// password for CRAM-MD5 if kept
+func (repo *MysqlRepository) LookupCredential(username string) (*server.Credential, error) {
+	cred, err := repo.findCredential(username)
+	if err != nil {
+		return nil, err
+	}
+	if !repo.plaintext {
+		cred.Password = ""
+	}
+	return cred, nil
+}
+
+func (repo *MysqlRepository) SaveEmail(addr *mail.Address, env *server.Envelope, r io.Reader) error {
+	path, err := repo.writeMailFile(addr.Name, r)
+	if err != nil {
+		debug.Debugf("SaveEmail error: %v", err)
+		return err
 	}
 
 	repo.locker.Lock()
 	defer repo.locker.Unlock()
 
-	sqlStr := "insert into email(`account`,`from`,`tos`,`data`) values(?,?,?,?)"
-	_, err := repo.db.Exec(sqlStr, addr.Name, from, tos, data)
+	var (
+		tos    = make([]string, 0, len(env.To))
+		notify string
+		orcpt  string
+	)
+	for _, to := range env.To {
+		tos = append(tos, to.Address)
+	}
+	if rcpt := env.Recipient(addr.Address); rcpt != nil {
+		notify, orcpt = strings.Join(rcpt.Notify, ","), rcpt.ORcpt
+	}
+	_, err = repo.db.Exec(sqlSaveEmail, addr.Name, env.From, strings.Join(tos, ","),
+		env.Body, env.SMTPUTF8, env.Ret, env.EnvID, notify, orcpt, path)
 	if err != nil {
 		debug.Debugf("SaveEmail error: %v", err)
+		os.Remove(path)
 	}
 	return err
 }
 
+// writeMailFile streams mail data into a new file in mailbox directory of username
+func (repo *MysqlRepository) writeMailFile(username string, r io.Reader) (string, error) {
+	dir := filepath.Join(repo.mailDir, username)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	file, err := ioutil.TempFile(dir, fmt.Sprintf("%d-", time.Now().UnixNano()))
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(file, r)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
 func multiExec(db *sql.DB, sqls ...string) error {
 	for _, sql := range sqls {
 		if _, err := db.Exec(sql); err != nil {
@@ -1,29 +1,115 @@
 package repository
 
 import (
-	"database/sql"
+	"io/ioutil"
+	"net/mail"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/mkideal/cmail/smtpd/server"
 )
 
 func TestRepo(t *testing.T) {
 	dbsource := os.Getenv("SMTPD_DB_SOURCE")
 	if dbsource == "" {
-		t.Errorf("please set non-empty env SMTPD_DB_SOURCE")
-		return
+		t.Skip("please set non-empty env SMTPD_DB_SOURCE")
 	}
-	db, err := sql.Open("mysql", dbsource)
+	dir, err := ioutil.TempDir("", "smtpd-mail-")
 	if err != nil {
-		t.Errorf("open db error: %v", err)
-		return
+		t.Fatal(err)
 	}
-	repo, err := NewMysqlRepository(db)
+	defer os.RemoveAll(dir)
+	repo, err := Mysql(dbsource, dir, false)
 	if err != nil {
-		t.Errorf("NewMysqlRepository error: %v", err)
+		t.Errorf("Mysql error: %v", err)
 		return
 	}
-	if err := repo.SaveEmail("from", "to", []byte("hello")); err != nil {
+	addr := &mail.Address{Name: "to", Address: "to@example.com"}
+	env := &server.Envelope{From: "from@example.com", To: []server.Recipient{{Address: addr.Address}}}
+	if err := repo.SaveEmail(addr, env, strings.NewReader("hello")); err != nil {
 		t.Errorf("SaveEmail error: %v", err)
 		return
 	}
 }
+
+// baseline schema of tables created by the first version
+const (
+	baselineTableEmail = "CREATE TABLE IF NOT EXISTS email (" +
+		"`id` INT NOT NULL AUTO_INCREMENT," +
+		"`username` varchar(64) NOT NULL," +
+		"`from` varchar(64) NOT NULL," +
+		"`tos` text NOT NULL," +
+		"`data` blob," +
+		"PRIMARY KEY ( id )" +
+		")"
+
+	baselineTableMailbox = "CREATE TABLE IF NOT EXISTS mailbox(" +
+		"`id` INT NOT NULL AUTO_INCREMENT," +
+		"`username` varchar(64) NOT NULL," +
+		"`address` varchar(64) NOT NULL," +
+		"`create_date` varchar(32) NOT NULL," +
+		"PRIMARY KEY ( id )" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8"
+)
+
+var columnPattern = regexp.MustCompile("`(\\w+)` \\w+(?:\\((\\d+)\\))?")
+
+// tableColumns returns table name and lengths of columns of CREATE TABLE
+// statement, length is 0 if not specified
+func tableColumns(stmt string) (string, map[string]int64) {
+	table := strings.Fields(strings.Split(stmt, "(")[0])[5]
+	columns := make(map[string]int64)
+	for _, m := range columnPattern.FindAllStringSubmatch(stmt, -1) {
+		columns[m[1]], _ = strconv.ParseInt(m[2], 10, 64)
+	}
+	return table, columns
+}
+
+func TestMigrationFromBaseline(t *testing.T) {
+	schema := make(map[string]int64)
+	for _, stmt := range []string{baselineTableEmail, baselineTableMailbox} {
+		table, columns := tableColumns(stmt)
+		for column, length := range columns {
+			schema[table+"."+column] = length
+		}
+	}
+	find := func(table, column string) (bool, int64, error) {
+		length, ok := schema[table+"."+column]
+		return ok, length, nil
+	}
+	stmts, err := migrationStatements(find)
+	if err != nil {
+		t.Fatalf("migrationStatements: %v", err)
+	}
+	for _, stmt := range stmts {
+		// ALTER TABLE table ADD|MODIFY COLUMN `column` definition
+		fields := strings.Fields(stmt)
+		_, columns := tableColumns("CREATE TABLE IF NOT EXISTS " + fields[2] + "(" + strings.Join(fields[5:], " "))
+		for column, length := range columns {
+			schema[fields[2]+"."+column] = length
+		}
+	}
+	for _, stmt := range []string{sqlCreateTableEmail, sqlCreateTableMailbox} {
+		table, columns := tableColumns(stmt)
+		for column, length := range columns {
+			if got, ok := schema[table+"."+column]; !ok {
+				t.Errorf("column %s.%s not added by migration", table, column)
+			} else if got < length {
+				t.Errorf("column %s.%s not widened by migration: %d < %d", table, column, got, length)
+			}
+		}
+	}
+
+	// nothing to do after migrated
+	if stmts, err := migrationStatements(find); err != nil || len(stmts) != 0 {
+		t.Errorf("migrate again: %q, %v", stmts, err)
+	}
+	// orcpt of old versions is widened
+	schema["email.orcpt"] = 255
+	if stmts, err := migrationStatements(find); err != nil || len(stmts) != 1 || !strings.Contains(stmts[0], "MODIFY COLUMN `orcpt` varchar(500)") {
+		t.Errorf("widen orcpt: %q, %v", stmts, err)
+	}
+}
@@ -2,7 +2,10 @@ package etc
 
 import (
 	"io/ioutil"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,20 +16,97 @@ import (
 )
 
 type Config struct {
-	Host           string `yaml:"host" cli:"H,host" usage:"listening host" dft:"0.0.0.0"`
-	Port           uint16 `yaml:"port" cli:"p,port" usage:"listening port" dft:"25"`
-	Debug          bool   `yaml:"debug" cli:"debug" usage:"enable debug mode" dft:"false"`
-	DBSource       string `yaml:"db_source" cli:"db-source" usage:"mysql db source" dft:"$SMTPD_DB_SOURCE"`
-	DomainName     string `yaml:"domain_name" cli:"dn,domain-name" usage:"my domain name"`
-	MaxSessionSize int    `yaml:"max_session_size" cli:"max-session-size" usage:"max size of sessions(less than max size of open files)" dft:"32768"`
-	MaxErrorSize   int    `yaml:"max_error_size" cli:"max-error-size" usage:"max size of errors" dft:"3"`
-	MaxBufferSize  int    `yaml:"max_buffer_size" cli:"max-buffer-szie" usage:"max size of buffer" dft:"6553600"`
-	MaxRecipients  int    `yaml:"max_recipients" cli:"max-recipients" usage:"max size of recipients" dft:"256"`
-	AllowDelay     bool   `yaml:"allow_delay" cli:"allow-delay" usage:"allow delay email" dft:"false"`
+	Host               string   `yaml:"host" cli:"H,host" usage:"listening host" dft:"0.0.0.0"`
+	Port               uint16   `yaml:"port" cli:"p,port" usage:"listening port" dft:"25"`
+	SMTPSPort          uint16   `yaml:"smtps_port" cli:"smtps-port" usage:"listening port of implicit TLS(SMTPS), disabled if 0" dft:"0"`
+	SubmissionPort     uint16   `yaml:"submission_port" cli:"submission-port" usage:"listening port of message submission, disabled if 0" dft:"0"`
+	LMTPPort           uint16   `yaml:"lmtp_port" cli:"lmtp-port" usage:"listening port of LMTP, disabled if 0" dft:"0"`
+	CertFile           string   `yaml:"cert_file" cli:"cert-file" usage:"TLS certificate file"`
+	KeyFile            string   `yaml:"key_file" cli:"key-file" usage:"TLS private key file"`
+	RequireTLS         string   `yaml:"require_tls" cli:"require-tls" usage:"TLS requirement of SMTP and LMTP listeners: none, before-auth or before-mail" dft:"none"`
+	Debug              bool     `yaml:"debug" cli:"debug" usage:"enable debug mode" dft:"false"`
+	User               string   `yaml:"user" cli:"user" usage:"user to run as after listeners opened"`
+	Group              string   `yaml:"group" cli:"group" usage:"group to run as after listeners opened(primary group of user if empty)"`
+	PidFile            string   `yaml:"pid_file" cli:"pid-file" usage:"file to write process id"`
+	DBSource           string   `yaml:"db_source" cli:"db-source" usage:"mysql db source" dft:"$SMTPD_DB_SOURCE"`
+	DomainName         string   `yaml:"domain_name" cli:"dn,domain-name" usage:"my domain name"`
+	MaxSessionSize     int      `yaml:"max_session_size" cli:"max-session-size" usage:"max size of sessions(less than max size of open files)" dft:"32768"`
+	MaxErrorSize       int      `yaml:"max_error_size" cli:"max-error-size" usage:"max size of errors" dft:"3"`
+	MaxBufferSize      int      `yaml:"max_buffer_size" cli:"max-buffer-szie" usage:"max size of buffer" dft:"6553600"`
+	MaxRecipients      int      `yaml:"max_recipients" cli:"max-recipients" usage:"max size of recipients" dft:"256"`
+	GreetingTimeout    int      `yaml:"greeting_timeout" cli:"greeting-timeout" usage:"seconds waiting for the first command after connected, no timeout if 0" dft:"300"`
+	CommandTimeout     int      `yaml:"command_timeout" cli:"command-timeout" usage:"seconds waiting for a command, no timeout if 0" dft:"300"`
+	DataInitTimeout    int      `yaml:"data_init_timeout" cli:"data-init-timeout" usage:"seconds waiting for mail data after 354 replied, no timeout if 0" dft:"120"`
+	DataBlockTimeout   int      `yaml:"data_block_timeout" cli:"data-block-timeout" usage:"seconds waiting for each block of mail data, no timeout if 0" dft:"180"`
+	DataTermTimeout    int      `yaml:"data_term_timeout" cli:"data-term-timeout" usage:"seconds to process mail data and reply after it terminated, no timeout if 0" dft:"600"`
+	ShutdownTimeout    int      `yaml:"shutdown_timeout" cli:"shutdown-timeout" usage:"seconds waiting for sessions in progress to complete when shutting down" dft:"30"`
+	SpoolDir           string   `yaml:"spool_dir" cli:"spool-dir" usage:"directory of spooled mail data(system temp directory if empty)"`
+	SpoolThreshold     int      `yaml:"spool_threshold" cli:"spool-threshold" usage:"max size of mail data held in memory" dft:"262144"`
+	MailDir            string   `yaml:"mail_dir" cli:"mail-dir" usage:"directory of stored emails" dft:"mail"`
+	AllowDelay         bool     `yaml:"allow_delay" cli:"allow-delay" usage:"allow delay email" dft:"false"`
+	PlaintextPasswords bool     `yaml:"plaintext_passwords" cli:"plaintext-passwords" usage:"keep plaintext passwords of mailboxes for CRAM-MD5, cleared if false" dft:"false"`
+	OAuthSecret        string   `yaml:"oauth_secret" cli:"oauth-secret" usage:"HMAC secret for verifying OAuth bearer tokens(JWT)"`
+	OAuthIssuer        string   `yaml:"oauth_issuer" cli:"oauth-issuer" usage:"expected issuer of OAuth bearer tokens"`
+	DisabledExtensions []string `yaml:"disabled_extensions" cli:"disable-extension" usage:"EHLO keyword of extension which should not be advertised, repeatable"`
+
+	// Listeners overrides host, ports and require_tls above if not empty
+	Listeners []Listener `yaml:"listeners" cli:"-"`
 
 	S_ServiceInfo string `yaml:"service_info" cli:"-"`
 }
 
+// Listener represents config of a listener
+type Listener struct {
+	// Network is one of tcp(default), tcp4, tcp6, unix and systemd
+	Network string `yaml:"network"`
+	// Address is host:port, path of unix socket, or name of sockets passed
+	// by systemd socket activation (FileDescriptorName, "unknown" if unnamed)
+	Address string `yaml:"address"`
+	// Mode is octal file mode of unix socket, e.g. "0660"
+	Mode string `yaml:"mode"`
+	// Protocol is one of smtp(default), submission and lmtp
+	Protocol string `yaml:"protocol"`
+	// TLS is one of starttls(default), implicit and none
+	TLS string `yaml:"tls"`
+	// RequireTLS is one of none(default), before-auth and before-mail
+	RequireTLS string `yaml:"require_tls"`
+	// Auth is one of optional(default), required and disabled
+	Auth string `yaml:"auth"`
+	// Relay is one of default, authenticated and none
+	Relay string `yaml:"relay"`
+	// ProxyProtocol reads PROXY protocol header of version 1 or 2 sent by
+	// TrustedProxies (CIDR notations or IP addresses, any peer of unix socket)
+	ProxyProtocol  bool     `yaml:"proxy_protocol"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// Limits of session, global config is used if 0
+	MaxMessageSize int `yaml:"max_message_size"`
+	MaxRecipients  int `yaml:"max_recipients"`
+	MaxErrors      int `yaml:"max_errors"`
+}
+
+// ListenerConfigs returns configured listeners, or listeners of host
+// and ports if no listener configured
+func (conf Config) ListenerConfigs() []Listener {
+	if len(conf.Listeners) > 0 {
+		return conf.Listeners
+	}
+	address := func(port uint16) string {
+		return net.JoinHostPort(conf.Host, strconv.Itoa(int(port)))
+	}
+	listeners := []Listener{{Address: address(conf.Port), RequireTLS: conf.RequireTLS}}
+	if conf.SMTPSPort != 0 {
+		listeners = append(listeners, Listener{Address: address(conf.SMTPSPort), TLS: "implicit"})
+	}
+	if conf.SubmissionPort != 0 {
+		listeners = append(listeners, Listener{Address: address(conf.SubmissionPort), Protocol: "submission"})
+	}
+	if conf.LMTPPort != 0 {
+		listeners = append(listeners, Listener{Address: address(conf.LMTPPort), Protocol: "lmtp", RequireTLS: conf.RequireTLS})
+	}
+	return listeners
+}
+
 //-------------
 // Load config
 //-------------
@@ -78,10 +158,37 @@ func LoadConfig(filename string, replaceArgs []string) error {
 
 	meta.conf = newConf
 	debug.Switch(meta.conf.Debug)
-	debug.Debugf("config:\n%v", debug.JSON(meta.conf))
+	debug.Debugf("config:\n%v", debug.JSON(meta.conf.redacted()))
 	return nil
 }
 
+// redacted returns copy of config with secrets hidden, for logging
+func (conf Config) redacted() Config {
+	if conf.OAuthSecret != "" {
+		conf.OAuthSecret = "REDACTED"
+	}
+	conf.DBSource = redactDBSource(conf.DBSource)
+	return conf
+}
+
+// redactDBSource hides password of mysql db source
+// [user[:password]@][net[(addr)]]/dbname[?param1=value1&paramN=valueN]
+func redactDBSource(source string) string {
+	slash := strings.LastIndex(source, "/")
+	if slash < 0 {
+		return source
+	}
+	at := strings.LastIndex(source[:slash], "@")
+	if at < 0 {
+		return source
+	}
+	colon := strings.Index(source[:at], ":")
+	if colon < 0 {
+		return source
+	}
+	return source[:colon+1] + "REDACTED" + source[at:]
+}
+
 func Conf() Config {
 	return meta.conf
 }
@@ -0,0 +1,19 @@
+package etc
+
+import "testing"
+
+func TestRedacted(t *testing.T) {
+	conf := Config{OAuthSecret: "secret", DBSource: "root:p@ss/word@tcp(127.0.0.1:3306)/smtpd?charset=utf8"}
+	redacted := conf.redacted()
+	if redacted.OAuthSecret != "REDACTED" || redacted.DBSource != "root:REDACTED@tcp(127.0.0.1:3306)/smtpd?charset=utf8" {
+		t.Errorf("unexpected redacted config %+v", redacted)
+	}
+	if conf.OAuthSecret != "secret" {
+		t.Errorf("config modified")
+	}
+	for _, source := range []string{"", "root@tcp(127.0.0.1:3306)/smtpd", "tcp(127.0.0.1:3306)/smtpd"} {
+		if got := redactDBSource(source); got != source {
+			t.Errorf("redactDBSource(%q) got %q", source, got)
+		}
+	}
+}
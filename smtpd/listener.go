@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mkideal/pkg/debug"
+
+	"github.com/mkideal/cmail/smtpd/etc"
+	"github.com/mkideal/cmail/smtpd/server"
+)
+
+// listener is a bound listener with policy of its sessions
+type listener struct {
+	net.Listener
+	network string
+	// key identifies the listener across restart
+	key    string
+	policy *server.Policy
+}
+
+// listen binds all configured listeners, none is left open on error
+func listen() ([]listener, error) {
+	activated, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	inherited, err := inheritedListeners()
+	if err != nil {
+		closeListeners(activated)
+		return nil, err
+	}
+	var listeners []listener
+	fail := func(conf etc.Listener, err error) ([]listener, error) {
+		for _, l := range listeners {
+			l.Close()
+		}
+		closeListeners(activated)
+		closeListeners(inherited)
+		return nil, fmt.Errorf("listener %s: %v", conf.Address, err)
+	}
+	for _, conf := range etc.Conf().ListenerConfigs() {
+		policy, err := newPolicy(conf)
+		if err != nil {
+			return fail(conf, err)
+		}
+		network := conf.Network
+		if network == "" {
+			network = "tcp"
+		}
+		key := listenerKey(network, conf.Address)
+		// listeners passed by the old process on restart are used first
+		if ls, ok := inherited[key]; ok {
+			delete(inherited, key)
+			for _, l := range ls {
+				listeners = append(listeners, listener{Listener: l, network: network, key: key, policy: policy})
+			}
+			continue
+		}
+		switch network {
+		case "systemd":
+			ls, ok := activated[conf.Address]
+			if !ok {
+				return fail(conf, errors.New("no socket passed by systemd"))
+			}
+			delete(activated, conf.Address)
+			for _, l := range ls {
+				listeners = append(listeners, listener{Listener: l, network: network, key: key, policy: policy})
+			}
+		case "tcp", "tcp4", "tcp6", "unix":
+			l, err := listenNetwork(network, conf)
+			if err != nil {
+				return fail(conf, err)
+			}
+			listeners = append(listeners, listener{Listener: l, network: network, key: key, policy: policy})
+		default:
+			return fail(conf, fmt.Errorf("unsupported network %q", network))
+		}
+	}
+	// sockets not configured are not served
+	for name := range activated {
+		debug.Debugf("socket %s passed by systemd not configured", name)
+	}
+	for key := range inherited {
+		debug.Debugf("listener %s passed by old process not configured", key)
+	}
+	closeListeners(activated)
+	closeListeners(inherited)
+	return listeners, nil
+}
+
+func listenNetwork(network string, conf etc.Listener) (net.Listener, error) {
+	if network != "unix" {
+		return net.Listen(network, conf.Address)
+	}
+	if err := removeStaleSocket(conf.Address); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen(network, conf.Address)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Mode != "" {
+		mode, err := strconv.ParseUint(conf.Mode, 8, 32)
+		if err == nil {
+			err = os.Chmod(conf.Address, os.FileMode(mode))
+		}
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("mode %s: %v", conf.Mode, err)
+		}
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes unix socket left by a process exited without
+// cleanup, socket which is still accepting connections is kept
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		// bind reports the error if any
+		return nil
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return errors.New("socket in use")
+	}
+	return os.Remove(path)
+}
+
+// newPolicy creates policy of sessions from listener config
+func newPolicy(conf etc.Listener) (*server.Policy, error) {
+	policy := &server.Policy{
+		MaxMessageSize: conf.MaxMessageSize,
+		MaxRecipients:  conf.MaxRecipients,
+		MaxErrors:      conf.MaxErrors,
+	}
+	switch strings.ToLower(conf.Protocol) {
+	case "", "smtp":
+	case "submission":
+		policy.Submission = true
+	case "lmtp":
+		policy.LMTP = true
+	default:
+		return nil, fmt.Errorf("invalid protocol %q", conf.Protocol)
+	}
+	switch strings.ToLower(conf.TLS) {
+	case "", "starttls":
+	case "implicit":
+		policy.ImplicitTLS = true
+	case "none":
+		policy.DisableStartTLS = true
+	default:
+		return nil, fmt.Errorf("invalid TLS mode %q", conf.TLS)
+	}
+	var err error
+	if policy.RequireTLS, err = server.ParseTLSRequirement(conf.RequireTLS); err != nil {
+		return nil, err
+	}
+	if policy.Auth, err = server.ParseAuthRequirement(conf.Auth); err != nil {
+		return nil, err
+	}
+	if policy.Relay, err = server.ParseRelayPolicy(conf.Relay); err != nil {
+		return nil, err
+	}
+	if conf.ProxyProtocol {
+		if len(conf.TrustedProxies) == 0 && conf.Network != "unix" {
+			return nil, errors.New("trusted_proxies required by proxy_protocol")
+		}
+		if policy.TrustedProxies, err = server.ParseNetworks(conf.TrustedProxies); err != nil {
+			return nil, err
+		}
+		policy.ProxyProtocol = true
+	}
+	return policy, nil
+}
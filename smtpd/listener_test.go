@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mkideal/cmail/smtpd/etc"
+	"github.com/mkideal/cmail/smtpd/server"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smtpd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "missing.sock")
+	if err := removeStaleSocket(path); err != nil {
+		t.Errorf("missing: unexpected error %v", err)
+	}
+
+	// regular file is left to bind
+	path = filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		t.Errorf("regular file: unexpected error %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("regular file removed: %v", err)
+	}
+
+	path = filepath.Join(dir, "smtpd.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("listen: %v", err)
+	}
+	if err := removeStaleSocket(path); err == nil {
+		t.Errorf("socket in use: want error")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("socket in use removed: %v", err)
+	}
+
+	// socket left by a process exited without cleanup
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if err := removeStaleSocket(path); err != nil {
+		t.Errorf("stale socket: unexpected error %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("stale socket not removed: %v", err)
+	}
+}
+
+// writeTestCertificate writes self-signed certificate and key of
+// localhost in dir
+func writeTestCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestImplicitTLSListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smtpd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificate(t, dir)
+	config := filepath.Join(dir, "smtpd.yaml")
+	if err := ioutil.WriteFile(config, []byte(`
+domain_name: example.com
+cert_file: `+certFile+`
+key_file: `+keyFile+`
+greeting_timeout: 10
+max_session_size: 10
+listeners:
+  - address: "127.0.0.1:0"
+    tls: implicit
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := etc.LoadConfig(config, nil); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+
+	listeners, err := listen()
+	if err != nil {
+		t.Skipf("listen: %v", err)
+	}
+	if len(listeners) != 1 || !listeners[0].policy.ImplicitTLS {
+		t.Fatalf("want a listener of implicit TLS, got %v", listeners)
+	}
+	svr := server.NewWithTLS(nil, etc.Conf().CertFile, etc.Conf().KeyFile)
+	if svr == nil {
+		t.Fatalf("load certificate %s error", etc.Conf().CertFile)
+	}
+	defer svr.Close()
+	go svr.ServeWithPolicy(context.Background(), listeners[0].Listener, listeners[0].policy)
+
+	conn, err := tls.Dial("tcp", listeners[0].Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, msg, err := textproto.NewConn(conn).ReadResponse(server.CodeServiceReady); err != nil {
+		t.Errorf("greeting: %v %s", err, msg)
+	}
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/mkideal/cli"
 
@@ -21,22 +26,118 @@ func run(ctx *cli.Context, argv *argT) error {
 		return err
 	}
 
-	repo, err := repository.Mysql(argv.DBSource)
+	repo, err := repository.Mysql(etc.Conf().DBSource, etc.Conf().MailDir, etc.Conf().PlaintextPasswords)
 	if err != nil {
 		return err
 	}
 
 	// new smtp server
-	svr := server.New(repo)
-	onErr := func(e error) { err = e }
-	addr := fmt.Sprintf("%s:%d", etc.Conf().Host, etc.Conf().Port)
-	svr.Start(addr, func(e error) {
-		err = e
-		if err == nil {
-			ctx.String("listening on %s\n", addr)
+	var svr *server.Server
+	if etc.Conf().CertFile != "" || etc.Conf().KeyFile != "" {
+		if svr = server.NewWithTLS(repo, etc.Conf().CertFile, etc.Conf().KeyFile); svr == nil {
+			return fmt.Errorf("load certificate %s error", etc.Conf().CertFile)
 		}
-	}, onErr)
-	return err
+	} else {
+		svr = server.New(repo)
+	}
+	svr.SetAuthenticator(repo)
+	svr.SetCredentialStore(repo)
+	svr.SetCramMD5(etc.Conf().PlaintextPasswords)
+	if etc.Conf().OAuthSecret != "" {
+		verifier := server.NewJWTVerifier([]byte(etc.Conf().OAuthSecret))
+		verifier.Issuer = etc.Conf().OAuthIssuer
+		svr.SetTokenVerifier(verifier)
+	}
+
+	listeners, err := listen()
+	if err != nil {
+		return err
+	}
+	if err := setupProcess(); err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return err
+	}
+	if etc.Conf().PidFile != "" {
+		defer removePidFile(etc.Conf().PidFile)
+	}
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		ctx.String("listening on %s %s\n", l.network, l.Addr())
+		go func(l listener) {
+			errc <- svr.ServeWithPolicy(context.Background(), l.Listener, l.policy)
+		}(l)
+	}
+
+	notifyReady()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	for {
+		select {
+		case err := <-errc:
+			svr.Close()
+			return err
+		case sig := <-sigc:
+			if sig == syscall.SIGUSR2 {
+				// a new process serves the listeners, and this one drains sessions
+				if err := restart(listeners); err != nil {
+					ctx.String("restart error: %v\n", err)
+					continue
+				}
+				ctx.String("new process started, shutting down\n")
+			} else {
+				ctx.String("received %v, shutting down\n", sig)
+			}
+			return shutdown(svr)
+		}
+	}
+}
+
+// setupProcess writes pidfile and drops privileges after listeners opened,
+// then checks whether the directories of data are writable
+func setupProcess() error {
+	var cred *credential
+	if etc.Conf().User != "" {
+		c, err := lookupCredential(etc.Conf().User, etc.Conf().Group)
+		if err != nil {
+			return err
+		}
+		cred = c
+	} else if etc.Conf().Group != "" {
+		return fmt.Errorf("group %s specified without user", etc.Conf().Group)
+	}
+	if etc.Conf().PidFile != "" {
+		if err := writePidFile(etc.Conf().PidFile, cred); err != nil {
+			return err
+		}
+	}
+	if cred != nil {
+		if err := dropPrivileges(cred); err != nil {
+			return fmt.Errorf("run as %s: %v", cred.name, err)
+		}
+	}
+	spoolDir := etc.Conf().SpoolDir
+	if spoolDir == "" {
+		spoolDir = os.TempDir()
+	}
+	if err := checkWritable("spool directory", spoolDir); err != nil {
+		return err
+	}
+	return checkWritable("mail directory", etc.Conf().MailDir)
+}
+
+// shutdown waits sessions in progress to complete in shutdown timeout,
+// then closes the rest
+func shutdown(svr *server.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(etc.Conf().ShutdownTimeout)*time.Second)
+	defer cancel()
+	if err := svr.Shutdown(ctx); err != nil {
+		svr.Close()
+		return err
+	}
+	return nil
 }
 
 func main() {
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// credential is the uid and gids to run as
+type credential struct {
+	name   string
+	uid    int
+	gid    int
+	groups []int
+}
+
+// lookupCredential looks up user and group, group is primary group of
+// user if empty
+func lookupCredential(username, groupname string) (*credential, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	c := &credential{name: username}
+	if c.uid, err = strconv.Atoi(u.Uid); err != nil {
+		return nil, fmt.Errorf("user %s: invalid uid %s", username, u.Uid)
+	}
+	gid := u.Gid
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			return nil, err
+		}
+		gid = g.Gid
+	}
+	if c.gid, err = strconv.Atoi(gid); err != nil {
+		return nil, fmt.Errorf("group %s: invalid gid %s", groupname, gid)
+	}
+	c.groups = []int{c.gid}
+	if groupname == "" {
+		// supplementary groups are kept only if group not specified
+		ids, err := u.GroupIds()
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if n, err := strconv.Atoi(id); err == nil && n != c.gid {
+				c.groups = append(c.groups, n)
+			}
+		}
+	}
+	return c, nil
+}
+
+// dropPrivileges switches the process to the credential, it is done
+// already if running as the user, e.g. started by restart
+func dropPrivileges(c *credential) error {
+	if os.Getuid() == c.uid && os.Getgid() == c.gid {
+		return nil
+	}
+	if err := syscall.Setgroups(c.groups); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(c.gid); err != nil {
+		return fmt.Errorf("setgid %d: %v", c.gid, err)
+	}
+	if err := syscall.Setuid(c.uid); err != nil {
+		return fmt.Errorf("setuid %d: %v", c.uid, err)
+	}
+	return nil
+}
+
+// checkWritable checks whether files can be created in the directory
+func checkWritable(what, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("%s %s not writable by uid %d: %v", what, dir, os.Getuid(), err)
+	}
+	f, err := ioutil.TempFile(dir, ".smtpd-")
+	if err != nil {
+		return fmt.Errorf("%s %s not writable by uid %d: %v", what, dir, os.Getuid(), err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// writePidFile writes process id to file. The file is owned by the user
+// to run as, so that it can be rewritten by the new process on restart.
+func writePidFile(filename string, c *credential) error {
+	if err := ioutil.WriteFile(filename, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return err
+	}
+	if c != nil && os.Getuid() != c.uid {
+		return os.Chown(filename, c.uid, c.gid)
+	}
+	return nil
+}
+
+// removePidFile removes the file if it's not rewritten by another process.
+// The file is truncated instead if the directory isn't writable after
+// privileges dropped, e.g. /run owned by root.
+func removePidFile(filename string) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil || string(bytes.TrimSpace(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		os.Truncate(filename, 0)
+	}
+}
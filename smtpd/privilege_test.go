@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestPidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smtpd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "smtpd.pid")
+	pid := strconv.Itoa(os.Getpid()) + "\n"
+
+	if err := writePidFile(filename, nil); err != nil {
+		t.Fatalf("writePidFile: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filename); err != nil || string(data) != pid {
+		t.Errorf("want %q, got %q, %v", pid, data, err)
+	}
+	removePidFile(filename)
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("pid file not removed: %v", err)
+	}
+
+	// rewritten by another process
+	if err := ioutil.WriteFile(filename, []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	removePidFile(filename)
+	if data, err := ioutil.ReadFile(filename); err != nil || string(data) != "1\n" {
+		t.Errorf("pid file of another process: got %q, %v", data, err)
+	}
+
+	// directory not writable after privileges dropped
+	if err := writePidFile(filename, nil); err != nil {
+		t.Fatalf("writePidFile: %v", err)
+	}
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0755)
+	if f, err := os.Create(filepath.Join(dir, "probe")); err == nil {
+		f.Close()
+		t.Skip("directory is writable regardless of mode, e.g. run as root")
+	}
+	removePidFile(filename)
+	if data, err := ioutil.ReadFile(filename); err != nil || len(data) != 0 {
+		t.Errorf("pid file not truncated: got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mkideal/pkg/debug"
+)
+
+//-------------------------------------
+// Restart with listener handoff
+//-------------------------------------
+
+// Environment variables passed to the new process on restart, listeners
+// are passed as file descriptors from listenFdsStart like socket activation
+// and followed by the write end of a pipe to notify the old process ready
+const (
+	envInheritedFds     = "SMTPD_INHERITED_FDS"
+	envInheritedFdNames = "SMTPD_INHERITED_FDNAMES"
+	envReadyFd          = "SMTPD_READY_FD"
+)
+
+// readyTimeout is how long the old process waits for the new one ready
+const readyTimeout = 30 * time.Second
+
+// listenerKey identifies a listener across restart by its config
+func listenerKey(network, address string) string {
+	return network + "/" + address
+}
+
+// inheritedListeners returns listeners passed by the old process on
+// restart grouped by keys
+func inheritedListeners() (map[string][]net.Listener, error) {
+	defer func() {
+		os.Unsetenv(envInheritedFds)
+		os.Unsetenv(envInheritedFdNames)
+	}()
+	n, err := strconv.Atoi(os.Getenv(envInheritedFds))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv(envInheritedFdNames), ":")
+	for i, name := range names {
+		if names[i], err = url.QueryUnescape(name); err != nil {
+			return nil, fmt.Errorf("inherited listener name %q: %v", name, err)
+		}
+	}
+	return fileListeners(n, names)
+}
+
+// notifyReady tells the old process that the new one is serving, the old
+// process then stops accepting and drains its sessions. systemd is told
+// as well if the service is of Type=notify.
+func notifyReady() {
+	if err := sdNotify("READY=1"); err != nil {
+		debug.Debugf("sd_notify error: %v", err)
+	}
+	defer os.Unsetenv(envReadyFd)
+	fd, err := strconv.Atoi(os.Getenv(envReadyFd))
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// restart starts a new process of smtpd with the listeners and waits for
+// it ready. The listeners are kept open and served by both processes
+// until the old one shuts down.
+func restart(listeners []listener) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var (
+		files = make([]*os.File, 0, len(listeners)+1)
+		names = make([]string, 0, len(listeners))
+	)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.Listener.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return fmt.Errorf("listener %s can't be passed", l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		names = append(names, url.QueryEscape(l.key))
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		envInheritedFds+"="+strconv.Itoa(len(listeners)),
+		envInheritedFdNames+"="+strings.Join(names, ":"),
+		envReadyFd+"="+strconv.Itoa(listenFdsStart+len(listeners)),
+	)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// the read end gets EOF if the new process exits before ready
+	w.Close()
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Wait()
+			return errors.New("new process exited before ready")
+		}
+	case <-time.After(readyTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return errors.New("timeout waiting for new process ready")
+	}
+	// systemd stops the service when the main process exits, unless the
+	// new process becomes the main one
+	if err := sdNotify("MAINPID=" + strconv.Itoa(cmd.Process.Pid)); err != nil {
+		debug.Debugf("sd_notify error: %v", err)
+	}
+	cmd.Process.Release()
+
+	// unix sockets are owned by the new process now
+	for _, l := range listeners {
+		if ul, ok := l.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return nil
+}
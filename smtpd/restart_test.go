@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInheritedListeners(t *testing.T) {
+	listeners, cleanup := testListeners(t)
+	defer cleanup()
+	var names, want []string
+	for _, l := range listeners {
+		key := listenerKey(l.Addr().Network(), l.Addr().String())
+		names = append(names, url.QueryEscape(key))
+		want = append(want, key+" "+l.Addr().String())
+	}
+	sort.Strings(want)
+	got := runListenersHelper(t, "inherited", []string{
+		envInheritedFds + "=3",
+		envInheritedFdNames + "=" + strings.Join(names, ":"),
+	}, listeners...)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smtpd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("listen: %v", err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if err := sdNotify("MAINPID=1234"); err != nil {
+		t.Fatalf("sdNotify: %v", err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "MAINPID=1234" {
+		t.Errorf("want MAINPID=1234, got %q, %v", buf[:n], err)
+	}
+}
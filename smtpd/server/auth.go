@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net/mail"
+	"strings"
+
+	"github.com/mkideal/pkg/debug"
+)
+
+// Authenticator verifies credentials of AUTH command
+type Authenticator interface {
+	// Authenticate returns the mailbox of user if username and password matched
+	Authenticate(username, password string) (*mail.Address, error)
+}
+
+var (
+	// ErrAuthFailed should be returned by Authenticator if credentials invalid
+	ErrAuthFailed = errors.New("authentication failed")
+
+	errAuthSyntax    = errors.New("malformed authentication response")
+	errAuthCancelled = errors.New("authentication cancelled")
+)
+
+//------------------
+// SASL mechanisms
+//------------------
+
+const (
+	mechPlain = "PLAIN"
+	mechLogin = "LOGIN"
+)
+
+// saslServer represents server side of a SASL mechanism
+type saslServer interface {
+	// next handles the client response and returns either a challenge,
+	// the authenticated mailbox or an error. response is nil if client
+	// sent no initial response.
+	next(response []byte) (challenge []byte, user *mail.Address, err error)
+}
+
+var saslMechanisms = map[string]func(s *session) saslServer{
+	mechPlain: newPlainServer,
+	mechLogin: newLoginServer,
+}
+
+// authMechanisms returns names of mechanisms available to the session,
+// challenge-response mechanisms come first
+func (s *session) authMechanisms() []string {
+	mechs := []string{}
+	if s.policy.Auth == AuthDisabled {
+		return mechs
+	}
+	if s.svr.creds != nil {
+		if s.tls {
+			mechs = append(mechs, mechScramSHA256Plus)
+		}
+		mechs = append(mechs, mechScramSHA256)
+		if s.svr.cramMD5 {
+			mechs = append(mechs, mechCramMD5)
+		}
+	}
+	if s.svr.tokens != nil {
+		mechs = append(mechs, mechOAuthBearer, mechXOAuth2)
+	}
+	if s.svr.auth != nil {
+		mechs = append(mechs, mechPlain, mechLogin)
+	}
+	return mechs
+}
+
+func (svr *Server) authenticate(username, password string) (*mail.Address, error) {
+	user, err := svr.auth.Authenticate(username, password)
+	if err == nil && user == nil {
+		err = ErrAuthFailed
+	}
+	return user, err
+}
+
+// PLAIN (RFC 4616)
+type plainServer struct {
+	s *session
+}
+
+func newPlainServer(s *session) saslServer {
+	return &plainServer{s: s}
+}
+
+func (m *plainServer) next(response []byte) ([]byte, *mail.Address, error) {
+	if response == nil {
+		return []byte{}, nil, nil
+	}
+	// message = [authzid] NUL authcid NUL passwd
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 || len(parts[1]) == 0 {
+		return nil, nil, errAuthSyntax
+	}
+	authzid, username, password := string(parts[0]), string(parts[1]), string(parts[2])
+	user, err := m.s.svr.authenticate(username, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	if authzid != "" && authzid != username && authzid != user.Name && authzid != user.Address {
+		debug.Debugf("session %d: user %q is not authorized to act as %q", m.s.id, username, authzid)
+		return nil, nil, ErrAuthFailed
+	}
+	return nil, user, nil
+}
+
+// LOGIN (draft-murchison-sasl-login)
+type loginServer struct {
+	s        *session
+	username string
+	step     int
+}
+
+func newLoginServer(s *session) saslServer {
+	return &loginServer{s: s}
+}
+
+var (
+	loginUsernameChallenge = []byte("Username:")
+	loginPasswordChallenge = []byte("Password:")
+)
+
+func (m *loginServer) next(response []byte) ([]byte, *mail.Address, error) {
+	switch m.step {
+	case 0:
+		m.step++
+		if response == nil {
+			return loginUsernameChallenge, nil, nil
+		}
+		// initial response carries the username
+		fallthrough
+	case 1:
+		m.step++
+		m.username = string(response)
+		return loginPasswordChallenge, nil, nil
+	default:
+		user, err := m.s.svr.authenticate(m.username, string(response))
+		return nil, user, err
+	}
+}
+
+//---------------
+// AUTH exchange
+//---------------
+
+// startAuth parses arguments of AUTH command: mechanism [initial-response]
+func (s *session) startAuth(args string) {
+	var (
+		strs = strings.Fields(args)
+		ir   []byte
+	)
+	if len(strs) == 0 || len(strs) > 2 {
+		s.responseErrorInParameter()
+		return
+	}
+	mech := strings.ToUpper(strs[0])
+	newMech, ok := saslMechanisms[mech]
+	if !ok || !s.mechanismEnabled(mech) {
+		s.responseAuthMechanismNotSupported()
+		return
+	}
+	if len(strs) == 2 {
+		var err error
+		if ir, err = decodeAuthResponse(s.auth[:0], strs[1]); err != nil {
+			s.responseErrorInParameter()
+			return
+		}
+		s.auth = ir
+	}
+	s.sasl = newMech(s)
+	s.stepAuth(ir)
+}
+
+// onAuthResponse handles a client line during the AUTH exchange
+func (s *session) onAuthResponse(line string) (quit bool) {
+	if line == "*" {
+		s.finishAuth(nil, errAuthCancelled)
+		return
+	}
+	response, err := decodeAuthResponse(s.auth[:0], line)
+	if err != nil {
+		s.finishAuth(nil, errAuthSyntax)
+		return
+	}
+	s.auth = response
+	s.stepAuth(response)
+	return
+}
+
+func (s *session) stepAuth(response []byte) {
+	challenge, user, err := s.sasl.next(response)
+	if err != nil || user != nil {
+		s.finishAuth(user, err)
+		return
+	}
+	s.responseAuthChallenge(base64.StdEncoding.EncodeToString(challenge))
+	s.setState(stateAuth)
+}
+
+func (s *session) finishAuth(user *mail.Address, err error) {
+	s.sasl = nil
+	s.auth = s.auth[0:0]
+	if err != nil {
+		debug.Debugf("session %d auth error: %v", s.id, err)
+		s.setState(stateExpectCmdMail | stateExpectCmdAuth)
+		switch err {
+		case errAuthCancelled, errAuthSyntax:
+			s.responseErrorInParameter()
+		case ErrAuthFailed:
+			s.responseAuthInvalid()
+		default:
+			s.responseAuthTempFailure()
+		}
+		return
+	}
+	s.user = user
+	debug.Debugf("session %d authenticated as %s", s.id, user.String())
+	s.setState(stateExpectCmdMail)
+	s.responseAuthSucceeded()
+}
+
+func (s *session) mechanismEnabled(mech string) bool {
+	for _, m := range s.authMechanisms() {
+		if m == mech {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeAuthResponse decodes base64 encoded response into dst,
+// "=" stands for an empty response
+func decodeAuthResponse(dst []byte, line string) ([]byte, error) {
+	if line == "=" {
+		return []byte{}, nil
+	}
+	n := base64.StdEncoding.DecodedLen(len(line))
+	if cap(dst) < n {
+		dst = make([]byte, n)
+	}
+	dst = dst[:n]
+	n, err := base64.StdEncoding.Decode(dst, []byte(line))
+	if err != nil {
+		return nil, err
+	}
+	return dst[:n], nil
+}
@@ -0,0 +1,418 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mkideal/cmail/smtpd/etc"
+)
+
+// CredentialStore provides secrets for challenge-response mechanisms
+// which can't be verified by Authenticator, e.g. CRAM-MD5 and SCRAM
+type CredentialStore interface {
+	// LookupCredential returns ErrAuthFailed if user not found
+	LookupCredential(username string) (*Credential, error)
+}
+
+// Credential holds secrets of a user
+type Credential struct {
+	Mailbox *mail.Address
+
+	// Password is the plaintext password, required by CRAM-MD5 only.
+	// SCRAM keys are derived from it if they are not present.
+	Password string
+
+	// SCRAM-SHA-256 (RFC 5802, RFC 7677) keys
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+const (
+	mechCramMD5         = "CRAM-MD5"
+	mechScramSHA256     = "SCRAM-SHA-256"
+	mechScramSHA256Plus = "SCRAM-SHA-256-PLUS"
+
+	scramIterations = 4096
+	scramNonceSize  = 18
+	scramSaltSize   = 16
+)
+
+// scramSaltKey generates salt of users without stored keys, so that the
+// same salt is sent to repeated attempts of a user
+var scramSaltKey = randomBytes(sha256.Size)
+
+func init() {
+	saslMechanisms[mechCramMD5] = newCramMD5Server
+	saslMechanisms[mechScramSHA256] = newScramServer
+	saslMechanisms[mechScramSHA256Plus] = newScramPlusServer
+}
+
+// NewCredential returns credential of mailbox with SCRAM-SHA-256 keys derived
+// from password and a random salt. The keys can be stored in place of the
+// password, they verify PLAIN and LOGIN by VerifyPassword as well as SCRAM.
+func NewCredential(mailbox *mail.Address, password string) *Credential {
+	cred := &Credential{Mailbox: mailbox, Salt: randomBytes(scramSaltSize), Iterations: scramIterations}
+	cred.StoredKey, cred.ServerKey = scramKeys(password, cred.Salt, cred.Iterations)
+	return cred
+}
+
+// VerifyPassword reports whether password matches SCRAM keys of credential
+func (cred *Credential) VerifyPassword(password string) bool {
+	if len(cred.StoredKey) == 0 || cred.Iterations <= 0 {
+		return false
+	}
+	storedKey, _ := scramKeys(password, cred.Salt, cred.Iterations)
+	return hmac.Equal(storedKey, cred.StoredKey)
+}
+
+func (svr *Server) lookupCredential(username string) (*Credential, error) {
+	cred, err := svr.creds.LookupCredential(username)
+	if err == nil && (cred == nil || cred.Mailbox == nil) {
+		err = ErrAuthFailed
+	}
+	return cred, err
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+//----------
+// CRAM-MD5
+//----------
+
+// CRAM-MD5 (RFC 2195)
+type cramMD5Server struct {
+	s         *session
+	challenge []byte
+}
+
+func newCramMD5Server(s *session) saslServer {
+	return &cramMD5Server{s: s}
+}
+
+func (m *cramMD5Server) next(response []byte) ([]byte, *mail.Address, error) {
+	if m.challenge == nil {
+		if response != nil {
+			return nil, nil, errAuthSyntax
+		}
+		m.challenge = []byte(fmt.Sprintf("<%x.%d@%s>", randomBytes(8), time.Now().Unix(), etc.Conf().DomainName))
+		return m.challenge, nil, nil
+	}
+	// response = username SP hex(HMAC-MD5(password, challenge))
+	index := bytes.LastIndexByte(response, ' ')
+	if index <= 0 {
+		return nil, nil, errAuthSyntax
+	}
+	digest, err := hex.DecodeString(string(response[index+1:]))
+	if err != nil {
+		return nil, nil, errAuthSyntax
+	}
+	cred, err := m.s.svr.lookupCredential(string(response[:index]))
+	if err != nil {
+		return nil, nil, err
+	}
+	if cred.Password == "" {
+		return nil, nil, ErrAuthFailed
+	}
+	h := hmac.New(md5.New, []byte(cred.Password))
+	h.Write(m.challenge)
+	if !hmac.Equal(h.Sum(nil), digest) {
+		return nil, nil, ErrAuthFailed
+	}
+	return nil, cred.Mailbox, nil
+}
+
+//---------------
+// SCRAM-SHA-256
+//---------------
+
+const (
+	cbindTLSExporter       = "tls-exporter"
+	cbindTLSServerEndPoint = "tls-server-end-point"
+)
+
+// SCRAM-SHA-256 and SCRAM-SHA-256-PLUS (RFC 5802, RFC 7677)
+type scramServer struct {
+	s    *session
+	plus bool
+	step int
+
+	gs2Header       string
+	cbindType       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	cred            *Credential
+	serverKey       []byte
+	storedKey       []byte
+}
+
+func newScramServer(s *session) saslServer {
+	return &scramServer{s: s}
+}
+
+func newScramPlusServer(s *session) saslServer {
+	return &scramServer{s: s, plus: true}
+}
+
+func (m *scramServer) next(response []byte) ([]byte, *mail.Address, error) {
+	m.step++
+	switch m.step {
+	case 1:
+		if response == nil {
+			m.step--
+			return []byte{}, nil, nil
+		}
+		return m.handleClientFirst(string(response))
+	case 2:
+		return m.handleClientFinal(string(response))
+	default:
+		// client acknowledges server-final-message with an empty response
+		if len(response) != 0 {
+			return nil, nil, errAuthSyntax
+		}
+		return nil, m.cred.Mailbox, nil
+	}
+}
+
+func (m *scramServer) handleClientFirst(msg string) ([]byte, *mail.Address, error) {
+	// client-first-message = gs2-cbind-flag "," [authzid] "," client-first-message-bare
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, nil, errAuthSyntax
+	}
+	flag, authzid := parts[0], parts[1]
+	switch {
+	case flag == "n":
+		if m.plus {
+			return nil, nil, errAuthSyntax
+		}
+	case flag == "y":
+		// client supports channel binding but thinks server doesn't,
+		// it's a downgrade attack if we advertised SCRAM-SHA-256-PLUS
+		if m.plus || m.s.mechanismEnabled(mechScramSHA256Plus) {
+			return nil, nil, ErrAuthFailed
+		}
+	case strings.HasPrefix(flag, "p="):
+		if !m.plus {
+			return nil, nil, errAuthSyntax
+		}
+		m.cbindType = flag[2:]
+		if m.cbindType != cbindTLSExporter && m.cbindType != cbindTLSServerEndPoint {
+			return nil, nil, errAuthSyntax
+		}
+	default:
+		return nil, nil, errAuthSyntax
+	}
+	if authzid != "" && !strings.HasPrefix(authzid, "a=") {
+		return nil, nil, errAuthSyntax
+	}
+	m.gs2Header = flag + "," + authzid + ","
+	m.clientFirstBare = parts[2]
+
+	attrs := parseScramAttributes(m.clientFirstBare)
+	username, ok := decodeSaslname(attrs["n"])
+	if !ok || username == "" || attrs["r"] == "" || attrs["m"] != "" {
+		return nil, nil, errAuthSyntax
+	}
+	// RFC 5802 5.1: authentication of unknown users fails after a fake
+	// challenge, so that users can't be enumerated
+	cred, err := m.s.svr.lookupCredential(username)
+	if err != nil && err != ErrAuthFailed {
+		return nil, nil, err
+	}
+	salt, iterations := scramSalt(username), scramIterations
+	if err == nil && len(cred.StoredKey) > 0 && len(cred.ServerKey) > 0 {
+		m.cred = cred
+		salt, iterations = cred.Salt, cred.Iterations
+		m.storedKey, m.serverKey = cred.StoredKey, cred.ServerKey
+	} else if err == nil && cred.Password != "" {
+		m.cred = cred
+		m.storedKey, m.serverKey = scramKeys(cred.Password, salt, iterations)
+	}
+	// unauthorized authzid fails after client-final as well
+	if m.cred != nil && authzid != "" {
+		if authz, ok := decodeSaslname(authzid[2:]); !ok || (authz != username && authz != cred.Mailbox.Name && authz != cred.Mailbox.Address) {
+			m.cred = nil
+		}
+	}
+	m.nonce = attrs["r"] + base64.RawStdEncoding.EncodeToString(randomBytes(scramNonceSize))
+	m.serverFirst = "r=" + m.nonce + ",s=" + base64.StdEncoding.EncodeToString(salt) + ",i=" + strconv.Itoa(iterations)
+	return []byte(m.serverFirst), nil, nil
+}
+
+func (m *scramServer) handleClientFinal(msg string) ([]byte, *mail.Address, error) {
+	// client-final-message = channel-binding "," nonce ["," extensions] "," proof
+	index := strings.LastIndex(msg, ",p=")
+	if index < 0 {
+		return nil, nil, errAuthSyntax
+	}
+	withoutProof := msg[:index]
+	attrs := parseScramAttributes(withoutProof)
+	proof, err := base64.StdEncoding.DecodeString(msg[index+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, nil, errAuthSyntax
+	}
+	if attrs["r"] != m.nonce {
+		return nil, nil, ErrAuthFailed
+	}
+	cbind, err := base64.StdEncoding.DecodeString(attrs["c"])
+	if err != nil {
+		return nil, nil, errAuthSyntax
+	}
+	cbindData, err := m.channelBindingData()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !hmac.Equal(cbind, append([]byte(m.gs2Header), cbindData...)) {
+		return nil, nil, ErrAuthFailed
+	}
+
+	authMessage := []byte(m.clientFirstBare + "," + m.serverFirst + "," + withoutProof)
+	clientSignature := hmacSum(sha256.New, m.storedKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if m.cred == nil || !hmac.Equal(storedKey[:], m.storedKey) {
+		return nil, nil, ErrAuthFailed
+	}
+	serverSignature := hmacSum(sha256.New, m.serverKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil, nil
+}
+
+// channelBindingData returns channel binding data of the TLS connection (RFC 5929, RFC 9266)
+func (m *scramServer) channelBindingData() ([]byte, error) {
+	if m.cbindType == "" {
+		return nil, nil
+	}
+	state := m.s.tlsState
+	if state == nil {
+		return nil, ErrAuthFailed
+	}
+	switch m.cbindType {
+	case cbindTLSExporter:
+		if state.Version < tls.VersionTLS13 {
+			return nil, ErrAuthFailed
+		}
+		return state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	default:
+		if m.s.svr.tlsConfig == nil || len(m.s.svr.tlsConfig.Certificates) == 0 {
+			return nil, ErrAuthFailed
+		}
+		return tlsServerEndPoint(m.s.svr.tlsConfig.Certificates[0].Certificate[0])
+	}
+}
+
+// tlsServerEndPoint returns hash of the server certificate (RFC 5929 4.1)
+func tlsServerEndPoint(der []byte) ([]byte, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	var h hash.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		h = sha512.New()
+	default:
+		// MD5 and SHA-1 are replaced by SHA-256
+		h = sha256.New()
+	}
+	h.Write(der)
+	return h.Sum(nil), nil
+}
+
+// scramKeys derives StoredKey and ServerKey from password
+func scramKeys(password string, salt []byte, iterations int) (storedKey, serverKey []byte) {
+	saltedPassword := scramHi(sha256.New, []byte(password), salt, iterations)
+	clientKey := hmacSum(sha256.New, saltedPassword, []byte("Client Key"))
+	sum := sha256.Sum256(clientKey)
+	return sum[:], hmacSum(sha256.New, saltedPassword, []byte("Server Key"))
+}
+
+// scramSalt returns salt of username for keys derived on the fly
+func scramSalt(username string) []byte {
+	return hmacSum(sha256.New, scramSaltKey, []byte(username))[:scramSaltSize]
+}
+
+// scramHi is the Hi function of RFC 5802, i.e. PBKDF2 with one block
+func scramHi(newHash func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(newHash, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func hmacSum(newHash func() hash.Hash, key, data []byte) []byte {
+	mac := hmac.New(newHash, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func parseScramAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, field := range strings.Split(s, ",") {
+		if len(field) >= 2 && field[1] == '=' {
+			attrs[field[:1]] = field[2:]
+		}
+	}
+	return attrs
+}
+
+// decodeSaslname replaces "=2C" and "=3D" with "," and "="
+func decodeSaslname(s string) (string, bool) {
+	if !strings.Contains(s, "=") {
+		return s, true
+	}
+	buf := new(bytes.Buffer)
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			buf.WriteByte(s[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(s[i:], "=2C"):
+			buf.WriteByte(',')
+		case strings.HasPrefix(s[i:], "=3D"):
+			buf.WriteByte('=')
+		default:
+			return "", false
+		}
+		i += 2
+	}
+	return buf.String(), true
+}
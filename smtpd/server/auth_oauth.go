@@ -0,0 +1,283 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// TokenVerifier verifies bearer tokens of OAUTHBEARER and XOAUTH2
+type TokenVerifier interface {
+	// VerifyToken returns the mailbox which token was issued to, user is
+	// the identity claimed by client and may be empty. ErrAuthFailed should
+	// be returned if token invalid.
+	VerifyToken(user, token string) (*mail.Address, error)
+}
+
+const (
+	mechOAuthBearer = "OAUTHBEARER"
+	mechXOAuth2     = "XOAUTH2"
+)
+
+func init() {
+	saslMechanisms[mechOAuthBearer] = newOAuthBearerServer
+	saslMechanisms[mechXOAuth2] = newXOAuth2Server
+}
+
+func (svr *Server) verifyToken(user, token string) (*mail.Address, error) {
+	addr, err := svr.tokens.VerifyToken(user, token)
+	if err == nil && addr == nil {
+		err = ErrAuthFailed
+	}
+	if err != nil {
+		return nil, err
+	}
+	if mailbox, ok := svr.repo.FindMailbox(addr.Address); ok {
+		addr = mailbox
+	}
+	return addr, nil
+}
+
+// oauthServer implements OAUTHBEARER (RFC 7628) and XOAUTH2
+type oauthServer struct {
+	s      *session
+	xoauth bool
+	failed bool
+}
+
+func newOAuthBearerServer(s *session) saslServer {
+	return &oauthServer{s: s}
+}
+
+func newXOAuth2Server(s *session) saslServer {
+	return &oauthServer{s: s, xoauth: true}
+}
+
+func (m *oauthServer) next(response []byte) ([]byte, *mail.Address, error) {
+	if m.failed {
+		// client acknowledged the error challenge
+		return nil, nil, ErrAuthFailed
+	}
+	if response == nil {
+		return []byte{}, nil, nil
+	}
+	var (
+		user, token string
+		ok          bool
+	)
+	if m.xoauth {
+		user, token, ok = parseXOAuth2Response(response)
+	} else {
+		user, token, ok = parseOAuthBearerResponse(response)
+	}
+	if !ok {
+		return nil, nil, errAuthSyntax
+	}
+	addr, err := m.s.svr.verifyToken(user, token)
+	if err == ErrAuthFailed {
+		// RFC 7628 3.2.2: server sends an error challenge and the client
+		// must respond with a dummy response
+		m.failed = true
+		return m.errorChallenge(), nil, nil
+	}
+	return nil, addr, err
+}
+
+func (m *oauthServer) errorChallenge() []byte {
+	status := "invalid_token"
+	if m.xoauth {
+		status = "401"
+	}
+	b, _ := json.Marshal(map[string]string{
+		"status":  status,
+		"schemes": "bearer",
+	})
+	return b
+}
+
+// parseOAuthBearerResponse parses client response of OAUTHBEARER:
+// gs2-header %x01 *(key "=" value %x01) %x01
+func parseOAuthBearerResponse(response []byte) (user, token string, ok bool) {
+	index := bytes.IndexByte(response, 0x01)
+	if index < 0 {
+		return
+	}
+	gs2 := strings.Split(string(response[:index]), ",")
+	if len(gs2) != 3 || gs2[0] != "n" && gs2[0] != "y" || gs2[2] != "" {
+		return
+	}
+	if gs2[1] != "" {
+		if !strings.HasPrefix(gs2[1], "a=") {
+			return
+		}
+		if user, ok = decodeSaslname(gs2[1][2:]); !ok {
+			return
+		}
+	}
+	token, ok = parseBearerAuth(response[index+1:])
+	return
+}
+
+// parseXOAuth2Response parses client response of XOAUTH2:
+// "user=" user %x01 "auth=Bearer " token %x01 %x01
+func parseXOAuth2Response(response []byte) (user, token string, ok bool) {
+	if !bytes.HasPrefix(response, []byte("user=")) {
+		return
+	}
+	index := bytes.IndexByte(response, 0x01)
+	if index < 0 {
+		return
+	}
+	user = string(response[len("user="):index])
+	token, ok = parseBearerAuth(response[index+1:])
+	return
+}
+
+func parseBearerAuth(kvpairs []byte) (token string, ok bool) {
+	if !bytes.HasSuffix(kvpairs, []byte{0x01}) {
+		return
+	}
+	for _, kv := range bytes.Split(kvpairs, []byte{0x01}) {
+		if !bytes.HasPrefix(kv, []byte("auth=")) {
+			continue
+		}
+		auth := string(kv[len("auth="):])
+		if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+			token = strings.TrimSpace(auth[7:])
+			return token, token != ""
+		}
+		return
+	}
+	return
+}
+
+//-------------
+// JWTVerifier
+//-------------
+
+// JWTVerifier verifies HMAC signed JSON Web Tokens (RFC 7519) offline.
+// Mailbox of token is taken from claim "email", or "sub" if absent.
+// Claim "exp" is required.
+type JWTVerifier struct {
+	Secret []byte
+
+	// Issuer and Audience are checked if non-empty
+	Issuer   string
+	Audience string
+
+	// Leeway is allowed clock skew when checking "exp" and "nbf"
+	Leeway time.Duration
+}
+
+func NewJWTVerifier(secret []byte) *JWTVerifier {
+	return &JWTVerifier{Secret: secret, Leeway: time.Minute}
+}
+
+var errMalformedToken = errors.New("malformed token")
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Email     string          `json:"email"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+func (v *JWTVerifier) VerifyToken(user, token string) (*mail.Address, error) {
+	claims, err := v.parse(token)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	now := time.Now()
+	// tokens without "exp" are refused, or they are valid forever once leaked
+	if claims.ExpiresAt == nil || now.Add(-v.Leeway).After(time.Unix(int64(*claims.ExpiresAt), 0)) {
+		return nil, ErrAuthFailed
+	}
+	if claims.NotBefore != nil && now.Add(v.Leeway).Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return nil, ErrAuthFailed
+	}
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return nil, ErrAuthFailed
+	}
+	if v.Audience != "" && !claims.hasAudience(v.Audience) {
+		return nil, ErrAuthFailed
+	}
+	address := claims.Email
+	if address == "" {
+		address = claims.Subject
+	}
+	if address == "" || (user != "" && user != address && user != claims.Subject) {
+		return nil, ErrAuthFailed
+	}
+	return &mail.Address{Address: address}, nil
+}
+
+func (v *JWTVerifier) parse(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedToken
+	}
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return nil, err
+	}
+	var newHash func() hash.Hash
+	switch header.Alg {
+	case "HS256":
+		newHash = sha256.New
+	case "HS384":
+		newHash = sha512.New384
+	case "HS512":
+		newHash = sha512.New
+	default:
+		return nil, errMalformedToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(signature, hmacSum(newHash, v.Secret, []byte(parts[0]+"."+parts[1]))) {
+		return nil, ErrAuthFailed
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	claims := new(jwtClaims)
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// hasAudience reports whether claim "aud", a string or an array of strings, contains aud
+func (c *jwtClaims) hasAudience(aud string) bool {
+	var single string
+	if err := json.Unmarshal(c.Audience, &single); err == nil {
+		return single == aud
+	}
+	var multi []string
+	if err := json.Unmarshal(c.Audience, &multi); err == nil {
+		for _, a := range multi {
+			if a == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
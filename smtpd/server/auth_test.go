@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/mail"
+	"testing"
+	"time"
+)
+
+type testAuthenticator map[string]string
+
+func (a testAuthenticator) Authenticate(username, password string) (*mail.Address, error) {
+	if p, ok := a[username]; ok && p == password {
+		return &mail.Address{Name: username, Address: username + "@example.com"}, nil
+	}
+	return nil, ErrAuthFailed
+}
+
+func newTestAuthSession() *session {
+	return &session{svr: &Server{auth: testAuthenticator{"alice": "secret"}}}
+}
+
+func TestPlainServer(t *testing.T) {
+	for i, tc := range []struct {
+		response string
+		user     string
+		err      error
+	}{
+		{"\x00alice\x00secret", "alice@example.com", nil},
+		{"alice\x00alice\x00secret", "alice@example.com", nil},
+		{"bob\x00alice\x00secret", "", ErrAuthFailed},
+		{"\x00alice\x00wrong", "", ErrAuthFailed},
+		{"alice\x00secret", "", errAuthSyntax},
+	} {
+		_, user, err := newPlainServer(newTestAuthSession()).next([]byte(tc.response))
+		if err != tc.err {
+			t.Errorf("%dth: error want %v, got %v", i, tc.err, err)
+			continue
+		}
+		if tc.user != "" && (user == nil || user.Address != tc.user) {
+			t.Errorf("%dth: user want %q, got %v", i, tc.user, user)
+		}
+	}
+}
+
+func TestLoginServer(t *testing.T) {
+	m := newLoginServer(newTestAuthSession())
+	challenge, _, _ := m.next(nil)
+	if string(challenge) != "Username:" {
+		t.Fatalf("unexpected challenge %q", challenge)
+	}
+	challenge, _, _ = m.next([]byte("alice"))
+	if string(challenge) != "Password:" {
+		t.Fatalf("unexpected challenge %q", challenge)
+	}
+	_, user, err := m.next([]byte("secret"))
+	if err != nil || user == nil || user.Name != "alice" {
+		t.Fatalf("login failed: user=%v, err=%v", user, err)
+	}
+}
+
+func TestDecodeAuthResponse(t *testing.T) {
+	if b, err := decodeAuthResponse(nil, "="); err != nil || len(b) != 0 {
+		t.Errorf("decode %q: got %q, %v", "=", b, err)
+	}
+	if b, err := decodeAuthResponse(nil, "AGFsaWNlAHNlY3JldA=="); err != nil || string(b) != "\x00alice\x00secret" {
+		t.Errorf("decode: got %q, %v", b, err)
+	}
+	if _, err := decodeAuthResponse(nil, "!!"); err == nil {
+		t.Errorf("decode %q: want error", "!!")
+	}
+}
+
+type testCredentialStore map[string]string
+
+func (cs testCredentialStore) LookupCredential(username string) (*Credential, error) {
+	if p, ok := cs[username]; ok {
+		return &Credential{Mailbox: &mail.Address{Name: username}, Password: p}, nil
+	}
+	return nil, ErrAuthFailed
+}
+
+func TestCramMD5Server(t *testing.T) {
+	// RFC 2195 example
+	s := &session{svr: &Server{creds: testCredentialStore{"tim": "tanstaaftanstaaf"}}}
+	m := &cramMD5Server{s: s, challenge: []byte("<1896.697170952@postoffice.reston.mci.net>")}
+	_, user, err := m.next([]byte("tim b913a602c7eda7a495b4e6e7334d3890"))
+	if err != nil || user == nil || user.Name != "tim" {
+		t.Fatalf("CRAM-MD5 failed: user=%v, err=%v", user, err)
+	}
+	m = &cramMD5Server{s: s, challenge: []byte("<1896.697170952@postoffice.reston.mci.net>")}
+	if _, _, err := m.next([]byte("tim 00000000000000000000000000000000")); err != ErrAuthFailed {
+		t.Fatalf("CRAM-MD5 with wrong digest: want %v, got %v", ErrAuthFailed, err)
+	}
+}
+
+func TestScramServerFinal(t *testing.T) {
+	// RFC 7677 example
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	storedKey, serverKey := scramKeys("pencil", salt, 4096)
+	m := &scramServer{
+		s:               &session{},
+		step:            1,
+		gs2Header:       "n,,",
+		clientFirstBare: "n=user,r=rOprNGfwEbeRWgbNEkqO",
+		serverFirst:     "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		nonce:           "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0",
+		cred:            &Credential{Mailbox: &mail.Address{Name: "user"}},
+		storedKey:       storedKey,
+		serverKey:       serverKey,
+	}
+	serverFinal, _, err := m.next([]byte("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="))
+	if err != nil {
+		t.Fatalf("SCRAM-SHA-256 failed: %v", err)
+	}
+	if want := "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="; string(serverFinal) != want {
+		t.Fatalf("server-final-message want %q, got %q", want, serverFinal)
+	}
+	if _, user, err := m.next([]byte{}); err != nil || user == nil || user.Name != "user" {
+		t.Fatalf("SCRAM-SHA-256 final step failed: user=%v, err=%v", user, err)
+	}
+}
+
+func TestScramUnknownUser(t *testing.T) {
+	s := &session{svr: &Server{creds: testCredentialStore{"user": "pencil"}}}
+	first := func(username string) (*scramServer, map[string]string) {
+		m := newScramServer(s).(*scramServer)
+		challenge, _, err := m.next([]byte("n,,n=" + username + ",r=rOprNGfwEbeRWgbNEkqO"))
+		if err != nil {
+			t.Fatalf("client-first of %s: %v", username, err)
+		}
+		return m, parseScramAttributes(string(challenge))
+	}
+	m, unknown := first("nobody")
+	if _, again := first("nobody"); again["s"] != unknown["s"] || again["i"] != unknown["i"] {
+		t.Errorf("fake challenge changed: %v, %v", unknown, again)
+	}
+	if _, known := first("user"); known["i"] != unknown["i"] || len(known["s"]) != len(unknown["s"]) {
+		t.Errorf("fake challenge distinguishable: %v, %v", known, unknown)
+	}
+	proof := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	if _, _, err := m.next([]byte("c=biws,r=" + m.nonce + ",p=" + proof)); err != ErrAuthFailed {
+		t.Errorf("client-final of unknown user: want %v, got %v", ErrAuthFailed, err)
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	cred := NewCredential(&mail.Address{Name: "alice"}, "secret")
+	if !cred.VerifyPassword("secret") {
+		t.Errorf("password not verified")
+	}
+	if cred.VerifyPassword("wrong") || cred.VerifyPassword("") {
+		t.Errorf("wrong password verified")
+	}
+	if (&Credential{Password: "secret"}).VerifyPassword("secret") {
+		t.Errorf("password verified without keys")
+	}
+	if other := NewCredential(cred.Mailbox, "secret"); bytes.Equal(other.Salt, cred.Salt) || bytes.Equal(other.StoredKey, cred.StoredKey) {
+		t.Errorf("same salt and key of different credentials")
+	}
+}
+
+func TestDecodeSaslname(t *testing.T) {
+	for _, tc := range []struct {
+		in, out string
+		ok      bool
+	}{
+		{"user", "user", true},
+		{"a=2Cb=3Dc", "a,b=c", true},
+		{"bad=2", "", false},
+	} {
+		if out, ok := decodeSaslname(tc.in); out != tc.out || ok != tc.ok {
+			t.Errorf("decodeSaslname(%q) want (%q, %v), got (%q, %v)", tc.in, tc.out, tc.ok, out, ok)
+		}
+	}
+}
+
+func signTestJWT(secret, payload string) string {
+	enc := base64.RawURLEncoding
+	signing := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(payload))
+	return signing + "." + enc.EncodeToString(hmacSum(sha256.New, []byte(secret), []byte(signing)))
+}
+
+func TestJWTVerifier(t *testing.T) {
+	v := NewJWTVerifier([]byte("secret"))
+	v.Issuer = "cmail"
+	exp := fmt.Sprintf(`"exp":%d`, time.Now().Add(time.Hour).Unix())
+	for i, tc := range []struct {
+		user, token string
+		err         error
+	}{
+		{"", signTestJWT("secret", `{"iss":"cmail","email":"a@example.com",`+exp+`}`), nil},
+		{"a@example.com", signTestJWT("secret", `{"iss":"cmail","sub":"a@example.com",`+exp+`}`), nil},
+		{"b@example.com", signTestJWT("secret", `{"iss":"cmail","email":"a@example.com",`+exp+`}`), ErrAuthFailed},
+		{"", signTestJWT("other", `{"iss":"cmail","email":"a@example.com",`+exp+`}`), ErrAuthFailed},
+		{"", signTestJWT("secret", `{"iss":"other","email":"a@example.com",`+exp+`}`), ErrAuthFailed},
+		{"", signTestJWT("secret", `{"iss":"cmail","email":"a@example.com","exp":1}`), ErrAuthFailed},
+		{"", signTestJWT("secret", `{"iss":"cmail","email":"a@example.com"}`), ErrAuthFailed},
+		{"", "not-a-token", ErrAuthFailed},
+	} {
+		addr, err := v.VerifyToken(tc.user, tc.token)
+		if err != tc.err {
+			t.Errorf("%dth: error want %v, got %v", i, tc.err, err)
+		} else if err == nil && addr.Address != "a@example.com" {
+			t.Errorf("%dth: unexpected address %q", i, addr.Address)
+		}
+	}
+}
+
+func TestParseOAuthResponse(t *testing.T) {
+	user, token, ok := parseOAuthBearerResponse([]byte("n,a=user@example.com,\x01host=server.example.com\x01port=587\x01auth=Bearer vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==\x01\x01"))
+	if !ok || user != "user@example.com" || token != "vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==" {
+		t.Errorf("OAUTHBEARER: got (%q, %q, %v)", user, token, ok)
+	}
+	user, token, ok = parseXOAuth2Response([]byte("user=someuser@example.com\x01auth=Bearer ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg\x01\x01"))
+	if !ok || user != "someuser@example.com" || token != "ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg" {
+		t.Errorf("XOAUTH2: got (%q, %q, %v)", user, token, ok)
+	}
+	if _, _, ok := parseOAuthBearerResponse([]byte("n,,\x01auth=Basic abc\x01\x01")); ok {
+		t.Errorf("OAUTHBEARER with Basic scheme: want failure")
+	}
+}
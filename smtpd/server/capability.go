@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mkideal/cmail/smtpd/etc"
+)
+
+// capability represents an EHLO keyword (RFC5321 4.1.1.1)
+type capability struct {
+	keyword string
+	// available reports whether the capability is available to the session,
+	// always available if nil
+	available func(s *session) bool
+	// params returns parameters of the keyword, none if nil
+	params func(s *session) string
+}
+
+// capabilities in the order of advertisement
+var capabilities []capability
+
+func registerCapability(keyword string, available func(s *session) bool, params func(s *session) string) {
+	capabilities = append(capabilities, capability{
+		keyword:   keyword,
+		available: available,
+		params:    params,
+	})
+}
+
+// hasCapability reports whether the extension is available to the session
+func (s *session) hasCapability(keyword string) bool {
+	for _, c := range capabilities {
+		if c.keyword == keyword {
+			return !isExtensionDisabled(keyword) && (c.available == nil || c.available(s))
+		}
+	}
+	return false
+}
+
+func isExtensionDisabled(keyword string) bool {
+	for _, disabled := range etc.Conf().DisabledExtensions {
+		if strings.EqualFold(disabled, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// extensions returns EHLO keywords with parameters advertised to the session
+func (s *session) extensions() []string {
+	exts := make([]string, 0, len(capabilities))
+	for _, c := range capabilities {
+		if isExtensionDisabled(c.keyword) || (c.available != nil && !c.available(s)) {
+			continue
+		}
+		e := c.keyword
+		if c.params != nil {
+			if params := c.params(s); params != "" {
+				e += " " + params
+			}
+		}
+		exts = append(exts, e)
+	}
+	return exts
+}
+
+func init() {
+	// RFC3207: STARTTLS is hidden if no certificate or TLS is active already
+	registerCapability(STARTTLS, func(s *session) bool {
+		return s.svr.tlsConfig != nil && !s.policy.DisableStartTLS && !s.tls
+	}, nil)
+
+	// RFC4954: AUTH mechanism *(SP mechanism), hidden until TLS is active if required
+	registerCapability(AUTH, func(s *session) bool {
+		if !s.tls && s.policy.tlsRequirement() >= TLSBeforeAuth {
+			return false
+		}
+		return len(s.authMechanisms()) > 0
+	}, func(s *session) string {
+		return strings.Join(s.authMechanisms(), " ")
+	})
+
+	// RFC1870 4: "SIZE" [SP size-param]
+	registerCapability(SIZE, nil, func(s *session) string {
+		return fmt.Sprintf("%d", s.policy.maxMessageSize())
+	})
+
+	registerCapability(PIPELINING, nil, nil)
+	registerCapability(EIGHT_BITMIME, nil, nil)
+	registerCapability(SMTPUTF8, nil, nil)
+	registerCapability(CHUNKING, nil, nil)
+	registerCapability(BINARYMIME, func(s *session) bool {
+		// BINARYMIME can't be sent without BDAT
+		return !isExtensionDisabled(CHUNKING)
+	}, nil)
+	registerCapability(DSN, nil, nil)
+	registerCapability(ENHANCEDSTATUSCODES, nil, nil)
+	registerCapability(VRFY, nil, nil)
+	registerCapability(HELP, nil, nil)
+}
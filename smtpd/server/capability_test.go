@@ -0,0 +1,53 @@
+package server
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestExtensions(t *testing.T) {
+	s := &session{svr: &Server{}, policy: defaultPolicy}
+	exts := strings.Join(s.extensions(), "\n")
+	for _, want := range []string{"SIZE 0", PIPELINING, CHUNKING, DSN, ENHANCEDSTATUSCODES} {
+		if !strings.Contains(exts, want) {
+			t.Errorf("want %s in %q", want, exts)
+		}
+	}
+	for _, unwanted := range []string{STARTTLS, AUTH} {
+		if strings.Contains(exts, unwanted) {
+			t.Errorf("unwanted %s in %q", unwanted, exts)
+		}
+	}
+
+	s.svr = &Server{tlsConfig: &tls.Config{}, auth: testAuthenticator{}}
+	s.policy = &Policy{Submission: true}
+	if !s.hasCapability(STARTTLS) || s.hasCapability(AUTH) {
+		t.Errorf("submission before TLS: want STARTTLS but not AUTH")
+	}
+	s.tls = true
+	if s.hasCapability(STARTTLS) || !s.hasCapability(AUTH) {
+		t.Errorf("submission after TLS: want AUTH but not STARTTLS")
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	s := &session{svr: &Server{auth: testAuthenticator{}}, policy: &Policy{RequireTLS: TLSBeforeAuth}}
+	if !s.requiresTLS(AUTH) || s.requiresTLS(MAIL) || s.hasCapability(AUTH) {
+		t.Errorf("before-auth: want AUTH hidden and rejected, MAIL accepted")
+	}
+	s.policy = &Policy{RequireTLS: TLSBeforeMail}
+	if !s.requiresTLS(AUTH) || !s.requiresTLS(MAIL) || s.requiresTLS(EHLO) {
+		t.Errorf("before-mail: want AUTH and MAIL rejected, EHLO accepted")
+	}
+	s.tls = true
+	if !s.hasCapability(AUTH) {
+		t.Errorf("before-mail after TLS: want AUTH")
+	}
+	if r, err := ParseTLSRequirement("Before-Mail"); err != nil || r != TLSBeforeMail {
+		t.Errorf("ParseTLSRequirement: got %v, %v", r, err)
+	}
+	if _, err := ParseTLSRequirement("always"); err == nil {
+		t.Errorf("ParseTLSRequirement: want error")
+	}
+}
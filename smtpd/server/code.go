@@ -5,24 +5,53 @@ const (
 	CodeHelpMessage                         = 214
 	CodeServiceReady                        = 220
 	CodeServiceClosing                      = 221
+	CodeAuthSucceeded                       = 235
 	CodeOK                                  = 250
 	CodeUserNotLocal                        = 251
 	CodeCannotVRFYUser                      = 252
+	CodeAuthContinue                        = 334
 	CodeStartMailInput                      = 354
 	CodeServiceNotAvailable                 = 421
 	CodeMailboxUnavailable                  = 450
 	CodeLocalErrorInProcessing              = 451
 	CodeInsufficientSystemStorage           = 452
+	CodeTempAuthFailure                     = 454
 	CodeServerUnableToAccommodateParameters = 455
 	CodeSyntaxError                         = 500
 	CodeSyntaxErrorInParametersOrArguments  = 501
 	CodePermCommandNotImplemented           = 502
 	CodePermBadSequenceOfCommands           = 503
 	CodePermCommandParameterNotImplemented  = 504
+	CodeAuthRequired                        = 530
 	CodePermMailboxUnavailable              = 550
 	CodePermUserNotLocal                    = 551
 	CodePermExceededStorageAllocation       = 552
 	CodePermMailboxNameNotAllowed           = 553
+	CodeAuthInvalid                         = 535
 	CodePermTransactionFailed               = 554
 	CodePermMailRcptParameterError          = 555
 )
+
+// Enhanced status codes (RFC3463)
+const (
+	EnhOK                     = "2.0.0"
+	EnhSenderOK               = "2.1.0"
+	EnhDestinationValid       = "2.1.5"
+	EnhAuthSucceeded          = "2.7.0"
+	EnhTempLocalError         = "4.3.0"
+	EnhTempSystemFull         = "4.3.1"
+	EnhTempSystemNotAccepting = "4.3.2"
+	EnhTempBadConnection      = "4.4.2"
+	EnhTooManyRecipients      = "4.5.3"
+	EnhTempAuthFailure        = "4.7.0"
+	EnhBadDestinationMailbox  = "5.1.1"
+	EnhBadDestinationSyntax   = "5.1.3"
+	EnhBadSenderSyntax        = "5.1.7"
+	EnhMessageTooBig          = "5.3.4"
+	EnhInvalidCommand         = "5.5.1"
+	EnhSyntaxError            = "5.5.2"
+	EnhInvalidArguments       = "5.5.4"
+	EnhSecurityPolicy         = "5.7.0"
+	EnhNotAuthorized          = "5.7.1"
+	EnhAuthCredentialsInvalid = "5.7.8"
+)
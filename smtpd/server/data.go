@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// dataReader reads mail data of DATA command. It removes the leading dot
+// of dot-stuffed lines and returns io.EOF at the terminator "CRLF.CRLF"
+// (RFC5321 4.5.2), line endings are kept as is.
+//
+// Only CRLF ends a line: a bare LF neither starts a line nor ends mail data,
+// or the mail may be ended at different places by servers (SMTP smuggling).
+// Mail data containing bare LF is read to the terminator and reported by
+// bareLF, it should be rejected (RFC5321 2.3.8).
+type dataReader struct {
+	r         *bufio.Reader
+	line      []byte
+	lineStart bool
+	lastCR    bool
+	done      bool
+	bareLF    bool
+}
+
+func newDataReader(r *bufio.Reader) *dataReader {
+	return &dataReader{r: r, lineStart: true}
+}
+
+func (dr *dataReader) Read(p []byte) (n int, err error) {
+	for len(dr.line) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		line, err := dr.r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		// CR of CRLF may be the last byte of previous slice
+		crlfEnded := err == nil && (len(line) >= 2 && line[len(line)-2] == '\r' || len(line) == 1 && dr.lastCR)
+		if err == nil && !crlfEnded {
+			dr.bareLF = true
+		}
+		lineStart := dr.lineStart
+		dr.lineStart = crlfEnded
+		dr.lastCR = line[len(line)-1] == '\r'
+		if lineStart && line[0] == '.' {
+			if bytes.Equal(line, []byte("."+crlf)) {
+				dr.done = true
+				return 0, io.EOF
+			}
+			line = line[1:]
+		}
+		dr.line = line
+	}
+	n = copy(p, dr.line)
+	dr.line = dr.line[n:]
+	return n, nil
+}
+
+// drain discards the rest of mail data
+func drain(r io.Reader) error {
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestDataReader(t *testing.T) {
+	for i, tc := range []struct {
+		input, data, rest string
+		err               error
+	}{
+		{"hello\r\n.\r\nQUIT\r\n", "hello\r\n", "QUIT\r\n", nil},
+		{".\r\n", "", "", nil},
+		{"..leading dot\r\n...\r\n.\r\n", ".leading dot\r\n..\r\n", "", nil},
+		{"a.\r\n .\r\n.\r\n", "a.\r\n .\r\n", "", nil},
+		{"unterminated\r\n", "unterminated\r\n", "", io.ErrUnexpectedEOF},
+		// bare LF never ends mail data (SMTP smuggling)
+		{"body\n.\r\nMAIL FROM:<x@evil>\r\n.\r\n", "body\n.\r\nMAIL FROM:<x@evil>\r\n", "", nil},
+		{"body\r\n.\nMAIL FROM:<x@evil>\r\n.\r\n", "body\r\n\nMAIL FROM:<x@evil>\r\n", "", nil},
+		{"bare lf\n.\n", "bare lf\n.\n", "", io.ErrUnexpectedEOF},
+	} {
+		r := bufio.NewReader(strings.NewReader(tc.input))
+		dr := newDataReader(r)
+		data, err := ioutil.ReadAll(dr)
+		if bareLF := strings.Contains(strings.Replace(tc.input, crlf, "", -1), "\n"); dr.bareLF != bareLF {
+			t.Errorf("%dth: bareLF want %v, got %v", i, bareLF, dr.bareLF)
+		}
+		if err != tc.err {
+			t.Errorf("%dth: error want %v, got %v", i, tc.err, err)
+			continue
+		}
+		if string(data) != tc.data {
+			t.Errorf("%dth: data want %q, got %q", i, tc.data, data)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != tc.rest {
+			t.Errorf("%dth: rest want %q, got %q", i, tc.rest, rest)
+		}
+	}
+}
+
+func TestDataReaderLongLine(t *testing.T) {
+	// lines longer than the bufio buffer must not be mistaken for terminators
+	long := strings.Repeat("x", 96) + ".\r\n"
+	r := bufio.NewReaderSize(strings.NewReader(long+".\r\n"), 16)
+	dr := newDataReader(r)
+	data, err := ioutil.ReadAll(dr)
+	if err != nil || string(data) != long || dr.bareLF {
+		t.Fatalf("got %q, %v, bare LF %v", data, err, dr.bareLF)
+	}
+}
+
+func TestDataReaderSplitCRLF(t *testing.T) {
+	// CRLF split by the bufio buffer still ends a line
+	input := strings.Repeat("x", 15) + "\r\n.\r\n"
+	r := bufio.NewReaderSize(strings.NewReader(input), 16)
+	dr := newDataReader(r)
+	data, err := ioutil.ReadAll(dr)
+	if err != nil || string(data) != input[:17] || dr.bareLF {
+		t.Fatalf("got %q, %v, bare LF %v", data, err, dr.bareLF)
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"strings"
+)
+
+// Delivery Status Notification (RFC3461)
+const (
+	DSN = "DSN"
+
+	// MAIL parameters
+	RET   = "RET"
+	ENVID = "ENVID"
+
+	// RCPT parameters
+	NOTIFY = "NOTIFY"
+	ORCPT  = "ORCPT"
+
+	RetFull = "FULL"
+	RetHdrs = "HDRS"
+
+	NotifyNever   = "NEVER"
+	NotifySuccess = "SUCCESS"
+	NotifyFailure = "FAILURE"
+	NotifyDelay   = "DELAY"
+
+	// RFC3461 4.4: ENVID must not exceed 100 characters
+	maxEnvIDLength = 100
+	// RFC3461 4.2: ORCPT must not exceed 500 characters
+	maxORcptLength = 500
+)
+
+// WantsNotify reports whether a DSN should be issued to the sender for
+// event, which is one of NotifySuccess, NotifyFailure and NotifyDelay
+func (rcpt *Recipient) WantsNotify(event string) bool {
+	if len(rcpt.Notify) == 0 {
+		// RFC3461 4.1: default is NOTIFY=FAILURE or NOTIFY=FAILURE,DELAY
+		return event == NotifyFailure || event == NotifyDelay
+	}
+	for _, notify := range rcpt.Notify {
+		if notify == event {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNotify parses NOTIFY="NEVER" / 1#( "SUCCESS" / "FAILURE" / "DELAY" )
+func parseNotify(value string) ([]string, bool) {
+	if value == "" {
+		return nil, false
+	}
+	list := strings.Split(strings.ToUpper(value), ",")
+	if len(list) == 1 && list[0] == NotifyNever {
+		return list, true
+	}
+	seen := make(map[string]bool)
+	for _, notify := range list {
+		switch notify {
+		case NotifySuccess, NotifyFailure, NotifyDelay:
+		default:
+			return nil, false
+		}
+		if seen[notify] {
+			return nil, false
+		}
+		seen[notify] = true
+	}
+	return list, true
+}
+
+// isValidORcpt checks ORCPT=addr-type ";" xtext, value is decoded already
+func isValidORcpt(value string) bool {
+	if len(value) > maxORcptLength {
+		return false
+	}
+	index := strings.Index(value, ";")
+	if index <= 0 || index == len(value)-1 {
+		return false
+	}
+	addrType := value[:index]
+	for i := 0; i < len(addrType); i++ {
+		if !isAtext(addrType[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func init() {
+	registerMailParam(RET, DSN, false, func(s *session, value string) error {
+		switch strings.ToUpper(value) {
+		case RetFull, RetHdrs:
+			return nil
+		}
+		return errParamSyntax
+	})
+	registerMailParam(ENVID, DSN, true, func(s *session, value string) error {
+		if value == "" || len(value) > maxEnvIDLength {
+			return errParamSyntax
+		}
+		return nil
+	})
+	registerRcptParam(NOTIFY, DSN, false, func(s *session, value string) error {
+		if _, ok := parseNotify(value); !ok {
+			return errParamSyntax
+		}
+		return nil
+	})
+	registerRcptParam(ORCPT, DSN, true, func(s *session, value string) error {
+		if !isValidORcpt(value) {
+			return errParamSyntax
+		}
+		return nil
+	})
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseNotify(t *testing.T) {
+	for i, tc := range []struct {
+		value  string
+		notify []string
+		ok     bool
+	}{
+		{"NEVER", []string{"NEVER"}, true},
+		{"success,failure", []string{"SUCCESS", "FAILURE"}, true},
+		{"SUCCESS,FAILURE,DELAY", []string{"SUCCESS", "FAILURE", "DELAY"}, true},
+		{"NEVER,SUCCESS", nil, false},
+		{"FAILURE,FAILURE", nil, false},
+		{"SOMETIMES", nil, false},
+		{"", nil, false},
+	} {
+		notify, ok := parseNotify(tc.value)
+		if ok != tc.ok || !reflect.DeepEqual(notify, tc.notify) {
+			t.Errorf("%dth: want (%v, %v), got (%v, %v)", i, tc.notify, tc.ok, notify, ok)
+		}
+	}
+}
+
+func TestWantsNotify(t *testing.T) {
+	rcpt := &Recipient{}
+	if !rcpt.WantsNotify(NotifyFailure) || rcpt.WantsNotify(NotifySuccess) {
+		t.Errorf("default NOTIFY should be FAILURE,DELAY")
+	}
+	rcpt.Notify = []string{NotifyNever}
+	if rcpt.WantsNotify(NotifyFailure) {
+		t.Errorf("NOTIFY=NEVER should suppress failure notifications")
+	}
+	rcpt.Notify = []string{NotifySuccess}
+	if !rcpt.WantsNotify(NotifySuccess) || rcpt.WantsNotify(NotifyFailure) {
+		t.Errorf("NOTIFY=SUCCESS mismatched")
+	}
+}
+
+func TestIsValidORcpt(t *testing.T) {
+	for value, ok := range map[string]bool{
+		"rfc822;a@b.com": true,
+		"utf-8;用户@b.com": true,
+		";a@b.com":       false,
+		"rfc822;":        false,
+		"a@b.com":        false,
+		"rfc822;" + strings.Repeat("a", maxORcptLength): false,
+	} {
+		if isValidORcpt(value) != ok {
+			t.Errorf("isValidORcpt(%q) want %v", value, ok)
+		}
+	}
+}
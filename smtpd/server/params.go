@@ -0,0 +1,377 @@
+package server
+
+import (
+	"errors"
+	"net/mail"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mkideal/cmail/smtpd/etc"
+	"golang.org/x/net/idna"
+)
+
+//--------------------
+// MAIL/RCPT arguments
+//--------------------
+
+var (
+	errPathSyntax    = errors.New("syntax error in mailbox")
+	errParamSyntax   = errors.New("syntax error in parameters")
+	errXtextSyntax   = errors.New("syntax error in xtext")
+	errNullPath      = errors.New("null path not allowed")
+	errPathTooLong   = errors.New("path too long")
+	errMissingPrefix = errors.New("missing FROM:/TO:")
+)
+
+// RFC5321 4.5.3.1.3: the maximum total length of a reverse-path or
+// forward-path is 256 octets (including the punctuation and element
+// separators)
+const maxPathLength = 256
+
+// parsePathArgs splits arguments of MAIL and RCPT (RFC5321 4.1.2):
+//
+//	prefix ":" Path [SP Mail-parameters]
+//	Path = "<" [ A-d-l ":" ] Mailbox ">"
+func parsePathArgs(args, prefix string) (path string, params []string, err error) {
+	if len(args) < len(prefix) || !strings.EqualFold(args[:len(prefix)], prefix) {
+		return "", nil, errMissingPrefix
+	}
+	// some clients put a space after the colon
+	args = strings.TrimLeft(args[len(prefix):], " ")
+	if !strings.HasPrefix(args, "<") {
+		// be liberal to clients which omit angle brackets
+		fields := strings.Fields(args)
+		if len(fields) == 0 {
+			return "", nil, errPathSyntax
+		}
+		if len(fields[0])+2 > maxPathLength {
+			return "", nil, errPathTooLong
+		}
+		return fields[0], fields[1:], nil
+	}
+	end := -1
+	quoted := false
+	for i := 1; i < len(args) && end < 0; i++ {
+		switch args[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case '>':
+			if !quoted {
+				end = i
+			}
+		}
+	}
+	if end < 0 {
+		return "", nil, errPathSyntax
+	}
+	if end+1 > maxPathLength {
+		return "", nil, errPathTooLong
+	}
+	rest := args[end+1:]
+	if rest != "" && rest[0] != ' ' {
+		return "", nil, errPathSyntax
+	}
+	return args[1:end], strings.Fields(rest), nil
+}
+
+// parseReversePath parses the path of MAIL, nil is returned for null path "<>".
+// UTF-8 mailbox is allowed if utf8 is true (RFC6531 3.3).
+func parseReversePath(path string, utf8 bool) (*mail.Address, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return parsePath(path, utf8)
+}
+
+// parseForwardPath parses the path of RCPT, "<Postmaster>" without domain is allowed
+func parseForwardPath(path string, utf8 bool) (*mail.Address, error) {
+	if path == "" {
+		return nil, errNullPath
+	}
+	if strings.EqualFold(path, "postmaster") {
+		return &mail.Address{Address: "postmaster@" + etc.Conf().DomainName}, nil
+	}
+	return parsePath(path, utf8)
+}
+
+func parsePath(path string, utf8 bool) (*mail.Address, error) {
+	// source routes must be accepted but ignored (RFC5321 4.1.2)
+	if strings.HasPrefix(path, "@") {
+		index := strings.Index(path, ":")
+		if index < 0 {
+			return nil, errPathSyntax
+		}
+		path = path[index+1:]
+	}
+	local, domain, err := parseMailbox(path, utf8)
+	if err != nil {
+		return nil, err
+	}
+	return &mail.Address{Address: local + "@" + domain}, nil
+}
+
+// parseMailbox parses Mailbox = Local-part "@" ( Domain / address-literal ),
+// internationalized domain is normalized to A-labels
+func parseMailbox(mailbox string, utf8 bool) (local, domain string, err error) {
+	index := strings.LastIndex(mailbox, "@")
+	if index <= 0 || index == len(mailbox)-1 {
+		return "", "", errPathSyntax
+	}
+	local, domain = mailbox[:index], mailbox[index+1:]
+	if !isValidLocalPart(local, utf8) {
+		return "", "", errPathSyntax
+	}
+	if !isASCII(domain) {
+		if !utf8 {
+			return "", "", errPathSyntax
+		}
+		if domain, err = idna.Lookup.ToASCII(domain); err != nil {
+			return "", "", errPathSyntax
+		}
+	}
+	if !isValidDomain(domain) {
+		return "", "", errPathSyntax
+	}
+	return local, domain, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Local-part = Dot-string / Quoted-string, non-ASCII characters are
+// allowed in atext and qtext if allowUTF8 is true
+func isValidLocalPart(local string, allowUTF8 bool) bool {
+	if !isASCII(local) && (!allowUTF8 || !utf8.ValidString(local)) {
+		return false
+	}
+	if strings.HasPrefix(local, `"`) {
+		if len(local) < 2 || !strings.HasSuffix(local, `"`) {
+			return false
+		}
+		for i := 1; i < len(local)-1; i++ {
+			c := local[i]
+			if c == '\\' {
+				i++
+				if i >= len(local)-1 || local[i] < 32 || local[i] == 127 {
+					return false
+				}
+				continue
+			}
+			if c == '"' || c < 32 || c == 127 {
+				return false
+			}
+		}
+		return true
+	}
+	for _, atom := range strings.Split(local, ".") {
+		if atom == "" {
+			return false
+		}
+		for i := 0; i < len(atom); i++ {
+			if atom[i] < utf8.RuneSelf && !isAtext(atom[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isAtext(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0
+}
+
+// Domain = sub-domain *("." sub-domain), or address-literal "[" ... "]"
+func isValidDomain(domain string) bool {
+	if strings.HasPrefix(domain, "[") {
+		return strings.HasSuffix(domain, "]") && len(domain) > 2
+	}
+	if len(domain) > 255 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//-----------------
+// ESMTP parameters
+//-----------------
+
+// esmtpParams holds parameters of MAIL or RCPT, keywords are upper case
+// and values of xtext parameters are decoded
+type esmtpParams map[string]string
+
+// newParamError returns a reply as error of parameter handlers
+func newParamError(code int, enhanced string, format string, args ...interface{}) *reply {
+	return newReplyf(code, enhanced, format, args...)
+}
+
+// paramHandler validates value of an ESMTP parameter, the error may be a *reply
+type paramHandler struct {
+	// capability is the EHLO keyword of the extension which defines the parameter,
+	// parameter is not recognized if the extension isn't available to the session
+	capability string
+	// xtext indicates value is encoded as xtext (RFC3461 4)
+	xtext  bool
+	handle func(s *session, value string) error
+}
+
+var (
+	mailParamHandlers = map[string]paramHandler{}
+	rcptParamHandlers = map[string]paramHandler{}
+)
+
+// registerMailParam registers a parameter of MAIL command
+func registerMailParam(keyword, capability string, xtext bool, handle func(s *session, value string) error) {
+	mailParamHandlers[strings.ToUpper(keyword)] = paramHandler{capability: capability, xtext: xtext, handle: handle}
+}
+
+// registerRcptParam registers a parameter of RCPT command
+func registerRcptParam(keyword, capability string, xtext bool, handle func(s *session, value string) error) {
+	rcptParamHandlers[strings.ToUpper(keyword)] = paramHandler{capability: capability, xtext: xtext, handle: handle}
+}
+
+// parseParams parses esmtp-param = esmtp-keyword ["=" esmtp-value]
+// and validates them by handlers
+func (s *session) parseParams(params []string, handlers map[string]paramHandler) (esmtpParams, error) {
+	result := make(esmtpParams, len(params))
+	for _, param := range params {
+		keyword, value := param, ""
+		if index := strings.Index(param, "="); index >= 0 {
+			keyword, value = param[:index], param[index+1:]
+		}
+		if !isValidKeyword(keyword) {
+			return nil, errParamSyntax
+		}
+		keyword = strings.ToUpper(keyword)
+		if _, dup := result[keyword]; dup {
+			return nil, errParamSyntax
+		}
+		handler, ok := handlers[keyword]
+		if !ok || (handler.capability != "" && !s.hasCapability(handler.capability)) {
+			return nil, newParamError(CodePermMailRcptParameterError, EnhInvalidArguments, "parameter %s not recognized", keyword)
+		}
+		if handler.xtext {
+			decoded, err := decodeXtext(value)
+			if err != nil {
+				return nil, err
+			}
+			value = decoded
+		}
+		if err := handler.handle(s, value); err != nil {
+			return nil, err
+		}
+		result[keyword] = value
+	}
+	return result, nil
+}
+
+// esmtp-keyword = (ALPHA / DIGIT) *(ALPHA / DIGIT / "-")
+func isValidKeyword(keyword string) bool {
+	if keyword == "" || keyword[0] == '-' {
+		return false
+	}
+	for i := 0; i < len(keyword); i++ {
+		c := keyword[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeXtext decodes xtext (RFC3461 4): "+" HEXCHAR HEXCHAR encodes a byte
+func decodeXtext(xtext string) (string, error) {
+	if !strings.Contains(xtext, "+") {
+		for i := 0; i < len(xtext); i++ {
+			if xtext[i] < 33 || xtext[i] > 126 || xtext[i] == '=' {
+				return "", errXtextSyntax
+			}
+		}
+		return xtext, nil
+	}
+	buf := make([]byte, 0, len(xtext))
+	for i := 0; i < len(xtext); i++ {
+		c := xtext[i]
+		switch {
+		case c == '+':
+			if i+3 > len(xtext) {
+				return "", errXtextSyntax
+			}
+			b, err := strconv.ParseUint(xtext[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", errXtextSyntax
+			}
+			buf = append(buf, byte(b))
+			i += 2
+		case c < 33 || c > 126 || c == '=':
+			return "", errXtextSyntax
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return string(buf), nil
+}
+
+//------------------
+// registered params
+//------------------
+
+func init() {
+	// RFC1870 6.1: reject the mail if the declared size exceeds the fixed maximum
+	registerMailParam(SIZE, SIZE, false, func(s *session, value string) error {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			return errParamSyntax
+		}
+		// RFC1870 4: "A parameter value of 0 (zero) indicates that no maximum
+		// message size is in force."
+		if maxSize := int64(s.policy.maxMessageSize()); maxSize > 0 && size > maxSize {
+			return newParamError(CodePermExceededStorageAllocation, EnhMessageTooBig, "message size exceeds fixed maximum message size")
+		}
+		return nil
+	})
+
+	// RFC6152 2: BODY=7BIT / BODY=8BITMIME
+	// RFC3030 3: BODY=BINARYMIME
+	registerMailParam(BODY, EIGHT_BITMIME, false, func(s *session, value string) error {
+		switch strings.ToUpper(value) {
+		case Body7Bit, Body8BitMIME:
+			return nil
+		case BodyBinaryMIME:
+			if s.hasCapability(BINARYMIME) {
+				return nil
+			}
+		}
+		return newParamError(CodePermCommandParameterNotImplemented, EnhInvalidArguments, "BODY=%s not supported", value)
+	})
+
+	// RFC6531 3.4: SMTPUTF8 parameter has no value
+	registerMailParam(SMTPUTF8, SMTPUTF8, false, func(s *session, value string) error {
+		if value != "" {
+			return errParamSyntax
+		}
+		return nil
+	})
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePathArgs(t *testing.T) {
+	for i, tc := range []struct {
+		args   string
+		path   string
+		params []string
+		ok     bool
+	}{
+		{"FROM:<a@b.com>", "a@b.com", nil, true},
+		{"from: <a@b.com> SIZE=100 BODY=8BITMIME", "a@b.com", []string{"SIZE=100", "BODY=8BITMIME"}, true},
+		{"FROM:<>", "", nil, true},
+		{`FROM:<"x >y"@b.com> SIZE=1`, `"x >y"@b.com`, []string{"SIZE=1"}, true},
+		{"FROM:a@b.com SIZE=1", "a@b.com", []string{"SIZE=1"}, true},
+		{"FROM:<a@b.com", "", nil, false},
+		{"FROM:<a@b.com>SIZE=1", "", nil, false},
+		{"TO:<a@b.com>", "", nil, false},
+		{"FROM:<" + strings.Repeat("a", 242) + "@example.com>", strings.Repeat("a", 242) + "@example.com", nil, true},
+		{"FROM:<" + strings.Repeat("a", 243) + "@example.com>", "", nil, false},
+		{"FROM:" + strings.Repeat("a", 243) + "@example.com", "", nil, false},
+	} {
+		path, params, err := parsePathArgs(tc.args, "FROM:")
+		if (err == nil) != tc.ok {
+			t.Errorf("%dth: unexpected error %v", i, err)
+			continue
+		}
+		if tc.ok && (path != tc.path || len(params)+len(tc.params) > 0 && !reflect.DeepEqual(params, tc.params)) {
+			t.Errorf("%dth: want (%q, %q), got (%q, %q)", i, tc.path, tc.params, path, params)
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	for i, tc := range []struct {
+		path, address string
+		ok            bool
+	}{
+		{"a@b.com", "a@b.com", true},
+		{"first.last+tag@sub.example.com", "first.last+tag@sub.example.com", true},
+		{"@relay1,@relay2:a@b.com", "a@b.com", true},
+		{`"quoted local"@b.com`, `"quoted local"@b.com`, true},
+		{"a@[192.168.0.1]", "a@[192.168.0.1]", true},
+		{"a..b@b.com", "", false},
+		{"a@-b.com", "", false},
+		{"a b@b.com", "", false},
+		{"ab.com", "", false},
+	} {
+		addr, err := parsePath(tc.path, false)
+		if (err == nil) != tc.ok {
+			t.Errorf("%dth: %q unexpected error %v", i, tc.path, err)
+			continue
+		}
+		if tc.ok && addr.Address != tc.address {
+			t.Errorf("%dth: want %q, got %q", i, tc.address, addr.Address)
+		}
+	}
+}
+
+func TestDecodeXtext(t *testing.T) {
+	for i, tc := range []struct {
+		xtext, text string
+		ok          bool
+	}{
+		{"rfc822;a@b.com", "rfc822;a@b.com", true},
+		{"rfc822;a+2Bb@b.com", "rfc822;a+b@b.com", true},
+		{"+3D", "=", true},
+		{"+3", "", false},
+		{"a=b", "", false},
+	} {
+		text, err := decodeXtext(tc.xtext)
+		if (err == nil) != tc.ok || text != tc.text {
+			t.Errorf("%dth: want (%q, %v), got (%q, %v)", i, tc.text, tc.ok, text, err)
+		}
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	handlers := map[string]paramHandler{
+		"SIZE":  {handle: func(*session, string) error { return nil }},
+		"ENVID": {xtext: true, handle: func(*session, string) error { return nil }},
+	}
+	s := &session{}
+	params, err := s.parseParams([]string{"size=10", "ENVID=a+2Bb"}, handlers)
+	if err != nil || params["SIZE"] != "10" || params["ENVID"] != "a+b" {
+		t.Errorf("got %v, %v", params, err)
+	}
+	if _, err := s.parseParams([]string{"SIZE=1", "SIZE=2"}, handlers); err == nil {
+		t.Errorf("duplicated parameter: want error")
+	}
+	if _, err := s.parseParams([]string{"FOO=1"}, handlers); err == nil {
+		t.Errorf("unknown parameter: want error")
+	} else if r, ok := err.(*reply); !ok || r.code != CodePermMailRcptParameterError {
+		t.Errorf("unknown parameter: want 555, got %v", err)
+	}
+}
+
+func TestParseUTF8Path(t *testing.T) {
+	if _, err := parsePath("用户@example.com", false); err == nil {
+		t.Errorf("UTF-8 local part without SMTPUTF8: want error")
+	}
+	addr, err := parsePath("用户@example.com", true)
+	if err != nil || addr.Address != "用户@example.com" {
+		t.Errorf("UTF-8 local part: got %v, %v", addr, err)
+	}
+	if _, err := parsePath("a@例え.jp", false); err == nil {
+		t.Errorf("UTF-8 domain without SMTPUTF8: want error")
+	}
+	if _, err := parsePath("\xff@example.com", true); err == nil {
+		t.Errorf("invalid UTF-8: want error")
+	}
+}
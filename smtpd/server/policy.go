@@ -0,0 +1,209 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/mkideal/cmail/smtpd/etc"
+)
+
+// Policy represents per-listener behavior of sessions
+type Policy struct {
+	// ImplicitTLS performs TLS handshake immediately after the connection
+	// accepted, i.e. SMTPS (RFC8314 3.3)
+	ImplicitTLS bool
+
+	// DisableStartTLS doesn't offer STARTTLS even if certificate loaded
+	DisableStartTLS bool
+
+	// Submission serves message submission (RFC6409): STARTTLS then AUTH
+	// are required before MAIL, the reverse-path must belong to the
+	// authenticated user, and missing Date/Message-ID fields are added
+	Submission bool
+
+	// LMTP serves local mail transfer protocol (RFC2033): LHLO instead of
+	// EHLO, and one reply for each recipient after mail data received
+	LMTP bool
+
+	// RequireTLS rejects commands issued before STARTTLS
+	RequireTLS TLSRequirement
+
+	// Auth specifies whether AUTH is offered or required before MAIL
+	Auth AuthRequirement
+
+	// Relay specifies who may send mail to non-local recipients
+	Relay RelayPolicy
+
+	// ProxyProtocol reads PROXY protocol header sent by trusted proxies
+	// before session, so that the address of the real client is used
+	ProxyProtocol  bool
+	TrustedProxies []*net.IPNet
+
+	// Limits of session, global config is used if 0
+	MaxMessageSize int
+	MaxRecipients  int
+	MaxErrors      int
+}
+
+var defaultPolicy = &Policy{}
+
+// TLSRequirement represents which commands require TLS
+type TLSRequirement int
+
+const (
+	TLSNone       TLSRequirement = iota // TLS not required
+	TLSBeforeAuth                       // TLS required before AUTH
+	TLSBeforeMail                       // TLS required before AUTH and MAIL
+)
+
+var tlsRequirementNames = map[string]TLSRequirement{
+	"none":        TLSNone,
+	"before-auth": TLSBeforeAuth,
+	"before-mail": TLSBeforeMail,
+}
+
+// ParseTLSRequirement parses TLS requirement by name: none, before-auth or before-mail
+func ParseTLSRequirement(name string) (TLSRequirement, error) {
+	if name == "" {
+		return TLSNone, nil
+	}
+	if r, ok := tlsRequirementNames[strings.ToLower(name)]; ok {
+		return r, nil
+	}
+	return TLSNone, fmt.Errorf("invalid TLS requirement %q", name)
+}
+
+// AuthRequirement represents whether AUTH is offered or required
+type AuthRequirement int
+
+const (
+	AuthOptional AuthRequirement = iota // AUTH offered if mechanisms available
+	AuthRequired                        // AUTH required before MAIL
+	AuthDisabled                        // AUTH not offered
+)
+
+var authRequirementNames = map[string]AuthRequirement{
+	"optional": AuthOptional,
+	"required": AuthRequired,
+	"disabled": AuthDisabled,
+}
+
+// ParseAuthRequirement parses AUTH requirement by name: optional, required or disabled
+func ParseAuthRequirement(name string) (AuthRequirement, error) {
+	if name == "" {
+		return AuthOptional, nil
+	}
+	if r, ok := authRequirementNames[strings.ToLower(name)]; ok {
+		return r, nil
+	}
+	return AuthOptional, fmt.Errorf("invalid auth requirement %q", name)
+}
+
+// RelayPolicy represents who may send mail to non-local recipients
+type RelayPolicy int
+
+const (
+	// RelayDefault allows authenticated users, and others whose mail comes
+	// from local domain or if delay allowed
+	RelayDefault RelayPolicy = iota
+	// RelayAuthenticated allows authenticated users only
+	RelayAuthenticated
+	// RelayNone accepts mail to local recipients only
+	RelayNone
+)
+
+var relayPolicyNames = map[string]RelayPolicy{
+	"default":       RelayDefault,
+	"authenticated": RelayAuthenticated,
+	"none":          RelayNone,
+}
+
+// ParseRelayPolicy parses relay policy by name: default, authenticated or none
+func ParseRelayPolicy(name string) (RelayPolicy, error) {
+	if name == "" {
+		return RelayDefault, nil
+	}
+	if r, ok := relayPolicyNames[strings.ToLower(name)]; ok {
+		return r, nil
+	}
+	return RelayDefault, fmt.Errorf("invalid relay policy %q", name)
+}
+
+// ParseNetworks parses CIDR notations or IP addresses
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", cidr)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// tlsRequirement returns the TLS requirement of policy, message submission
+// requires TLS before MAIL always
+func (policy *Policy) tlsRequirement() TLSRequirement {
+	if policy.Submission && policy.RequireTLS < TLSBeforeMail {
+		return TLSBeforeMail
+	}
+	return policy.RequireTLS
+}
+
+// authRequired reports whether AUTH is required before MAIL, message
+// submission requires AUTH always
+func (policy *Policy) authRequired() bool {
+	return policy.Submission || policy.Auth == AuthRequired
+}
+
+func (policy *Policy) maxMessageSize() int {
+	if policy.MaxMessageSize > 0 {
+		return policy.MaxMessageSize
+	}
+	return etc.Conf().MaxBufferSize
+}
+
+func (policy *Policy) maxRecipients() int {
+	if policy.MaxRecipients > 0 {
+		return policy.MaxRecipients
+	}
+	return etc.Conf().MaxRecipients
+}
+
+func (policy *Policy) maxErrors() int {
+	if policy.MaxErrors > 0 {
+		return policy.MaxErrors
+	}
+	return etc.Conf().MaxErrorSize
+}
+
+func (svr *Server) checkPolicy(policy *Policy) error {
+	if policy == nil {
+		policy = defaultPolicy
+	}
+	if (policy.ImplicitTLS || policy.tlsRequirement() != TLSNone) && svr.tlsConfig == nil {
+		return errors.New("TLS certificate required")
+	}
+	if policy.DisableStartTLS && !policy.ImplicitTLS && policy.tlsRequirement() != TLSNone {
+		return errors.New("TLS required but STARTTLS disabled")
+	}
+	if policy.authRequired() && policy.Auth == AuthDisabled {
+		return errors.New("AUTH required but disabled")
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/mail"
+	"testing"
+)
+
+func TestCheckPolicy(t *testing.T) {
+	plain := &Server{}
+	secure := &Server{tlsConfig: &tls.Config{}}
+	for _, tc := range []struct {
+		svr    *Server
+		policy *Policy
+		ok     bool
+	}{
+		{plain, nil, true},
+		{plain, &Policy{ImplicitTLS: true}, false},
+		{plain, &Policy{RequireTLS: TLSBeforeAuth}, false},
+		{secure, &Policy{Submission: true}, true},
+		{secure, &Policy{Submission: true, DisableStartTLS: true}, false},
+		{secure, &Policy{Submission: true, DisableStartTLS: true, ImplicitTLS: true}, true},
+		{secure, &Policy{Submission: true, Auth: AuthDisabled}, false},
+	} {
+		if err := tc.svr.checkPolicy(tc.policy); (err == nil) != tc.ok {
+			t.Errorf("checkPolicy(%+v): got %v", tc.policy, err)
+		}
+	}
+}
+
+func TestRelayPolicy(t *testing.T) {
+	user := &mail.Address{Address: "alice@example.com"}
+	for _, tc := range []struct {
+		relay RelayPolicy
+		user  *mail.Address
+		want  bool
+	}{
+		{RelayDefault, user, true},
+		{RelayAuthenticated, user, true},
+		{RelayAuthenticated, nil, false},
+		{RelayNone, user, false},
+	} {
+		s := &session{policy: &Policy{Relay: tc.relay}, user: tc.user}
+		if got := s.relayAllowed(); got != tc.want {
+			t.Errorf("relay %d, user %v: got %v", tc.relay, tc.user, got)
+		}
+	}
+	if r, err := ParseRelayPolicy("Authenticated"); err != nil || r != RelayAuthenticated {
+		t.Errorf("ParseRelayPolicy: got %v, %v", r, err)
+	}
+	if _, err := ParseAuthRequirement("maybe"); err == nil {
+		t.Errorf("ParseAuthRequirement: want error")
+	}
+}
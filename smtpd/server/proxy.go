@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+//--------------------------------------
+// PROXY protocol version 1 and 2 (HAProxy)
+//--------------------------------------
+
+var (
+	errProxyHeader = errors.New("invalid PROXY protocol header")
+
+	// signature of version 2 header
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// max length of version 1 header including CRLF
+	maxProxyV1Length = 107
+
+	proxyV2Local = 0x20
+	proxyV2Proxy = 0x21
+
+	proxyV2TCP4 = 0x11
+	proxyV2TCP6 = 0x21
+)
+
+// proxyConn is a connection accepted from proxy, RemoteAddr returns the
+// address of the real client
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// isTrustedProxy reports whether PROXY protocol header is accepted from
+// addr, header is required from trusted proxies and never parsed from others
+func (policy *Policy) isTrustedProxy(addr net.Addr) bool {
+	if !policy.ProxyProtocol {
+		return false
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UnixAddr:
+		// peer of unix socket is local
+		return true
+	default:
+		return false
+	}
+	for _, network := range policy.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads PROXY protocol header of version 1 or 2 from c,
+// and returns the connection with address of the real client
+func readProxyHeader(c net.Conn) (net.Conn, error) {
+	r := bufio.NewReader(c)
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	var remote net.Addr
+	if bytes.Equal(sig, proxyV2Signature) {
+		remote, err = readProxyV2(r)
+	} else {
+		remote, err = readProxyV1(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		// health check of proxy, or protocol not supported
+		remote = c.RemoteAddr()
+	}
+	return &proxyConn{Conn: c, r: r, remote: remote}, nil
+}
+
+// "PROXY" SP ("TCP4" / "TCP6") SP src SP dst SP sport SP dport CRLF
+// "PROXY" SP "UNKNOWN" [anything] CRLF
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) >= maxProxyV1Length {
+			return nil, errProxyHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte(crlf)) {
+		return nil, errProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") || net.ParseIP(fields[3]) == nil {
+		return nil, errProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// signature, version and command, family and protocol, length, addresses
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	var (
+		command = header[12]
+		family  = header[13]
+		length  = binary.BigEndian.Uint16(header[14:])
+	)
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	switch command {
+	case proxyV2Local:
+		return nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, errProxyHeader
+	}
+	// TLVs following addresses are ignored
+	switch family {
+	case proxyV2TCP4:
+		if len(payload) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case proxyV2TCP6:
+		if len(payload) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// readProxy writes header and data from client, and returns the
+// connection read by readProxyHeader
+func readProxy(t *testing.T, header []byte) (net.Conn, error) {
+	client, conn := net.Pipe()
+	t.Cleanup(func() { client.Close(); conn.Close() })
+	go func() {
+		client.Write(append(header, "EHLO a\r\n"...))
+	}()
+	return readProxyHeader(conn)
+}
+
+func TestReadProxyV1(t *testing.T) {
+	c, err := readProxy(t, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("remote address: got %s", got)
+	}
+	buf := make([]byte, 8)
+	if _, err := c.Read(buf); err != nil || string(buf) != "EHLO a\r\n" {
+		t.Errorf("data after header: got %q, %v", buf, err)
+	}
+
+	for _, header := range []string{
+		"PROXY TCP4 2001:db8::1 192.0.2.2 1 25\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 1\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 70000 25\r\n",
+		"EHLO client.example.com\r\n",
+	} {
+		if _, err := readProxy(t, []byte(header)); err == nil {
+			t.Errorf("%q: want error", header)
+		}
+	}
+	if c, err := readProxy(t, []byte("PROXY UNKNOWN\r\n")); err != nil || c.RemoteAddr() == nil {
+		t.Errorf("UNKNOWN: want address of connection, got %v", err)
+	}
+}
+
+func TestReadProxyV2(t *testing.T) {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, proxyV2Proxy, proxyV2TCP6, 0, 36+3)
+	header = append(header, net.ParseIP("2001:db8::1")...)
+	header = append(header, net.ParseIP("2001:db8::2")...)
+	header = append(header, 0, 0, 0, 25)
+	binary.BigEndian.PutUint16(header[len(header)-4:], 56324)
+	// TLV ignored
+	header = append(header, 0x04, 0, 0)
+
+	c, err := readProxy(t, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.RemoteAddr().String(); got != "[2001:db8::1]:56324" {
+		t.Errorf("remote address: got %s", got)
+	}
+	data := make([]byte, 8)
+	if _, err := io.ReadFull(c, data); err != nil || !bytes.Equal(data, []byte("EHLO a\r\n")) {
+		t.Errorf("data after header: got %q, %v", data, err)
+	}
+}
+
+func TestTrustedProxy(t *testing.T) {
+	networks, err := ParseNetworks([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &Policy{ProxyProtocol: true, TrustedProxies: networks}
+	for addr, want := range map[string]bool{
+		"10.1.2.3:1000":  true,
+		"192.0.2.1:1000": true,
+		"192.0.2.2:1000": false,
+	} {
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+		if got := policy.isTrustedProxy(tcpAddr); got != want {
+			t.Errorf("%s: got %v", addr, got)
+		}
+	}
+	if (&Policy{TrustedProxies: networks}).isTrustedProxy(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}) {
+		t.Errorf("PROXY protocol disabled: want untrusted")
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// reply represents a SMTP reply which consists of basic status code,
+// enhanced status code (RFC3463) and one or more lines of text
+type reply struct {
+	code int
+	// enhanced status code, e.g. "5.1.1", empty if the reply has none
+	enhanced string
+	lines    []string
+}
+
+func newReply(code int, enhanced string, lines ...string) *reply {
+	return &reply{code: code, enhanced: enhanced, lines: lines}
+}
+
+func newReplyf(code int, enhanced string, format string, args ...interface{}) *reply {
+	return newReply(code, enhanced, fmt.Sprintf(format, args...))
+}
+
+// format returns lines of the reply without trailing CRLF:
+//
+//	Reply-line = *( Reply-code "-" [ textstring ] CRLF )
+//	             Reply-code [ SP textstring ] CRLF
+func (r *reply) format() []string {
+	lines := r.lines
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+	result := make([]string, 0, len(lines))
+	for i, line := range lines {
+		sep := "-"
+		if i+1 == len(lines) {
+			sep = " "
+		}
+		text := line
+		if r.enhanced != "" {
+			text = strings.TrimRight(r.enhanced+" "+line, " ")
+		}
+		result = append(result, fmt.Sprintf("%3d%s%s", r.code, sep, text))
+	}
+	return result
+}
+
+func (r *reply) Error() string {
+	return strings.Join(r.format(), crlf)
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReplyFormat(t *testing.T) {
+	for i, tc := range []struct {
+		reply *reply
+		lines []string
+	}{
+		{newReply(CodeOK, EnhOK, "OK"), []string{"250 2.0.0 OK"}},
+		{newReply(CodeAuthContinue, ""), []string{"334 "}},
+		{newReply(CodeOK, "", "mx.example.com", "PIPELINING", "SIZE 100"), []string{"250-mx.example.com", "250-PIPELINING", "250 SIZE 100"}},
+		{newReplyf(CodePermMailboxUnavailable, EnhBadDestinationMailbox, "%s unknown", "a@b.com"), []string{"550 5.1.1 a@b.com unknown"}},
+	} {
+		if lines := tc.reply.format(); !reflect.DeepEqual(lines, tc.lines) {
+			t.Errorf("%dth: want %q, got %q", i, tc.lines, lines)
+		}
+	}
+}
@@ -1,19 +1,66 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"io"
 	"net"
 	"net/mail"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/mkideal/cmail/smtpd/etc"
+	"github.com/mkideal/pkg/debug"
 )
 
 // Repository represents email repository
 type Repository interface {
 	FindMailbox(usernameOrAddress string) (*mail.Address, bool)
-	SaveEmail(addr *mail.Address, from, tos string, data []byte) error
+	// SaveEmail stores mail data read from r, which may be backed by a file
+	SaveEmail(addr *mail.Address, env *Envelope, r io.Reader) error
+}
+
+// Envelope holds envelope information of a mail transaction
+type Envelope struct {
+	// From is the reverse-path, empty for null reverse-path
+	From string
+	To   []Recipient
+
+	// Body is BODY parameter of MAIL, i.e. 7BIT, 8BITMIME or BINARYMIME
+	Body string
+	// SMTPUTF8 indicates mail may contain UTF-8 addresses and headers (RFC6531)
+	SMTPUTF8 bool
+
+	// DSN parameters of MAIL (RFC3461 4.3, 4.4), empty if not specified
+	Ret   string
+	EnvID string
+
+	// TLS is the connection state if mail received over TLS, otherwise nil
+	TLS *tls.ConnectionState
+}
+
+// Recipient holds a forward-path and its DSN parameters (RFC3461 4.1, 4.2)
+type Recipient struct {
+	Address string
+
+	// Notify is NEVER, or any of SUCCESS, FAILURE and DELAY.
+	// It's empty if not specified, see WantsNotify.
+	Notify []string
+	// ORcpt is the original recipient as addr-type ";" addr
+	ORcpt string
+}
+
+// Recipient returns the recipient of address, nil if not found
+func (env *Envelope) Recipient(address string) *Recipient {
+	for i := range env.To {
+		if strings.EqualFold(env.To[i].Address, address) {
+			return &env.To[i]
+		}
+	}
+	return nil
 }
 
 //--------
@@ -22,13 +69,35 @@ type Repository interface {
 
 type Server struct {
 	repo      Repository
+	auth      Authenticator
+	creds     CredentialStore
+	cramMD5   bool
+	tokens    TokenVerifier
 	tlsConfig *tls.Config
 
 	locker       sync.Mutex
 	sessions     map[uint64]*session
+	listeners    map[net.Listener]struct{}
 	curSessionId uint64
+	inShutdown   int32
 }
 
+// ErrServerClosed is returned by Serve after Shutdown or Close
+var ErrServerClosed = errors.New("smtpd: server closed")
+
+// shutdownPollInterval is how often sessions are checked during Shutdown
+const shutdownPollInterval = 500 * time.Millisecond
+
+// backoff of retrying temporary accept errors
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+
+	// proxyHeaderTimeout is timeout of reading PROXY protocol header if
+	// greeting timeout is 0
+	proxyHeaderTimeout = 30 * time.Second
+)
+
 func New(repo Repository) *Server {
 	return newServer(repo, "", "")
 }
@@ -41,6 +110,7 @@ func newServer(repo Repository, certFile, keyFile string) *Server {
 	svr := new(Server)
 	svr.repo = repo
 	svr.sessions = make(map[uint64]*session)
+	svr.listeners = make(map[net.Listener]struct{})
 	if certFile != "" || keyFile != "" {
 		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 		if err != nil {
@@ -55,26 +125,221 @@ func newServer(repo Repository, certFile, keyFile string) *Server {
 	return svr
 }
 
+// SetAuthenticator enables AUTH command, credentials are verified by auth
+func (svr *Server) SetAuthenticator(auth Authenticator) {
+	svr.auth = auth
+}
+
+// SetCredentialStore enables challenge-response AUTH mechanisms
+// SCRAM-SHA-256 and SCRAM-SHA-256-PLUS, and CRAM-MD5 if enabled
+func (svr *Server) SetCredentialStore(creds CredentialStore) {
+	svr.creds = creds
+}
+
+// SetCramMD5 enables CRAM-MD5, which requires plaintext passwords
+// returned by CredentialStore
+func (svr *Server) SetCramMD5(enabled bool) {
+	svr.cramMD5 = enabled
+}
+
+// SetTokenVerifier enables OAUTHBEARER and XOAUTH2 AUTH mechanisms
+func (svr *Server) SetTokenVerifier(tokens TokenVerifier) {
+	svr.tokens = tokens
+}
+
+// Start listens on addr and serves sessions with default policy
 func (svr *Server) Start(addr string, onListenErr, onAcceptErr func(error)) {
+	svr.StartWithPolicy(addr, nil, onListenErr, onAcceptErr)
+}
+
+// StartWithPolicy listens on addr and serves sessions with policy
+func (svr *Server) StartWithPolicy(addr string, policy *Policy, onListenErr, onAcceptErr func(error)) {
+	if err := svr.checkPolicy(policy); err != nil {
+		onListenErr(err)
+		return
+	}
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		onListenErr(err)
 		return
 	}
 	onListenErr(nil)
+	onAcceptErr(svr.ServeWithPolicy(context.Background(), listener, policy))
+}
+
+// Serve accepts connections on listener and serves sessions with default
+// policy until ctx done, Shutdown or Close. It always returns a non-nil
+// error and closes listener: ErrServerClosed after Shutdown or Close,
+// ctx.Err() after ctx done.
+func (svr *Server) Serve(ctx context.Context, listener net.Listener) error {
+	return svr.ServeWithPolicy(ctx, listener, nil)
+}
+
+// ServeWithPolicy is like Serve but serves sessions with policy
+func (svr *Server) ServeWithPolicy(ctx context.Context, listener net.Listener, policy *Policy) error {
+	if policy == nil {
+		policy = defaultPolicy
+	}
+	if err := svr.checkPolicy(policy); err != nil {
+		listener.Close()
+		return err
+	}
+	if !svr.trackListener(listener, true) {
+		listener.Close()
+		return ErrServerClosed
+	}
+	defer svr.trackListener(listener, false)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-done:
+		}
+	}()
+
+	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
 		c, err := listener.Accept()
 		if err != nil {
-			onAcceptErr(err)
+			if svr.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// retry temporary errors like EMFILE, or the listener is lost
+			if ne, ok := err.(net.Error); ok && (ne.Temporary() || ne.Timeout()) {
+				if tempDelay == 0 {
+					tempDelay = minAcceptDelay
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > maxAcceptDelay {
+					tempDelay = maxAcceptDelay
+				}
+				debug.Debugf("accept error: %v; retrying in %v", err, tempDelay)
+				select {
+				case <-time.After(tempDelay):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		go svr.serveConn(c, policy)
+	}
+}
+
+// serveConn reads PROXY protocol header if sent by trusted proxy, then
+// runs session on the connection
+func (svr *Server) serveConn(c net.Conn, policy *Policy) {
+	if policy.isTrustedProxy(c.RemoteAddr()) {
+		// the connection isn't closed by Shutdown or Close before the session
+		// is added, so the header must be read in limited time
+		timeout := seconds(etc.Conf().GreetingTimeout)
+		if timeout <= 0 {
+			timeout = proxyHeaderTimeout
+		}
+		c.SetReadDeadline(deadline(timeout))
+		pc, err := readProxyHeader(c)
+		if err != nil {
+			debug.Debugf("read PROXY protocol header from %v error: %v", c.RemoteAddr(), err)
+			c.Close()
 			return
 		}
-		s := newSession(svr, c)
-		s.id = svr.allocSessionId()
-		if svr.addSession(s) {
-			//TODO: 超时退出session
-			go s.run()
+		c.SetReadDeadline(time.Time{})
+		c = pc
+	}
+	if policy.ImplicitTLS {
+		c = tls.Server(c, svr.tlsConfig)
+	}
+	s := newSession(svr, c, policy)
+	s.id = svr.allocSessionId()
+	if svr.addSession(s) {
+		s.run()
+	} else {
+		c.Close()
+	}
+}
+
+// Shutdown gracefully shuts down the server: listeners are closed, idle
+// sessions are closed with 421, and sessions in progress, e.g. receiving
+// mail data, are waited to complete. If ctx done before all sessions
+// completed, ctx.Err() is returned and Close may be used to close them.
+func (svr *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&svr.inShutdown, 1)
+	svr.closeListeners()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if svr.closeIdleSessions() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes all listeners and sessions
+func (svr *Server) Close() error {
+	atomic.StoreInt32(&svr.inShutdown, 1)
+	svr.closeListeners()
+
+	svr.locker.Lock()
+	defer svr.locker.Unlock()
+	for _, s := range svr.sessions {
+		s.rawConn.Close()
+	}
+	return nil
+}
+
+func (svr *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&svr.inShutdown) != 0
+}
+
+// trackListener adds or removes listener, false returned if adding
+// after server shutdown
+func (svr *Server) trackListener(listener net.Listener, add bool) bool {
+	svr.locker.Lock()
+	defer svr.locker.Unlock()
+	if !add {
+		delete(svr.listeners, listener)
+		return true
+	}
+	if svr.shuttingDown() {
+		return false
+	}
+	svr.listeners[listener] = struct{}{}
+	return true
+}
+
+func (svr *Server) closeListeners() {
+	svr.locker.Lock()
+	defer svr.locker.Unlock()
+	for listener := range svr.listeners {
+		listener.Close()
+	}
+}
+
+// closeIdleSessions interrupts sessions waiting for a command, which reply
+// 421 and quit, and reports whether there is no session left
+func (svr *Server) closeIdleSessions() bool {
+	svr.locker.Lock()
+	defer svr.locker.Unlock()
+	for _, s := range svr.sessions {
+		if s.isIdle() {
+			s.rawConn.SetReadDeadline(time.Now())
 		}
 	}
+	return len(svr.sessions) == 0
 }
 
 func (svr *Server) allocSessionId() uint64 {
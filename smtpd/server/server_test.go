@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServeShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("listen: %v", err)
+	}
+	svr := New(nil)
+	errc := make(chan error, 1)
+	go func() { errc <- svr.Serve(context.Background(), listener) }()
+
+	// wait for listener tracked
+	for i := 0; i < 100; i++ {
+		svr.locker.Lock()
+		n := len(svr.listeners)
+		svr.locker.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := svr.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case err := <-errc:
+		if err != ErrServerClosed {
+			t.Errorf("Serve: want ErrServerClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Serve not returned after Shutdown")
+	}
+	if err := svr.Serve(context.Background(), listener); err != ErrServerClosed {
+		t.Errorf("Serve after Shutdown: want ErrServerClosed, got %v", err)
+	}
+}
+
+func TestServeContextDone(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := New(nil).Serve(ctx, listener); err != context.Canceled {
+		t.Errorf("want context.Canceled, got %v", err)
+	}
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Temporary() bool { return true }
+func (temporaryError) Timeout() bool   { return false }
+
+// failingListener fails Accept with errs in order
+type failingListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+func TestServeRetriesTemporaryError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("listen: %v", err)
+	}
+	defer listener.Close()
+	closed := errors.New("listener closed")
+	l := &failingListener{Listener: listener, errs: []error{temporaryError{}, temporaryError{}, temporaryError{}, closed}}
+	if err := New(nil).Serve(context.Background(), l); err != closed {
+		t.Errorf("want %v, got %v", closed, err)
+	}
+	if len(l.errs) != 0 {
+		t.Errorf("Serve returned before %d errors", len(l.errs))
+	}
+}
+
+func TestShutdownInterruptsIdleSession(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	svr := New(nil)
+	s := newSession(svr, conn, defaultPolicy)
+	svr.sessions[s.id] = s
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	s.idle = 1
+	if err := svr.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("session left: want DeadlineExceeded, got %v", err)
+	}
+	if _, err := s.conn.ReadLine(); !isTimeout(err) {
+		t.Errorf("idle session: want interrupted, got %v", err)
+	}
+}
@@ -3,24 +3,23 @@ package server
 import (
 	"bytes"
 	"crypto/tls"
-	"fmt"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"math"
 	"net"
 	"net/mail"
 	//"net/smtp"
 	"net/textproto"
-	"regexp"
-	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/mkideal/cmail/smtpd/etc"
 	"github.com/mkideal/pkg/debug"
 )
 
-var (
-	fromRegexp = regexp.MustCompile("[Ff][Rr][Oo][Mm]:(.+)")
-	toRegexp   = regexp.MustCompile("[Tt][Oo]:(.+)")
-)
-
 const crlf = "\r\n"
 
 //---------
@@ -33,71 +32,70 @@ const (
 	HELP     = "HELP"
 	VRFY     = "VRFY"
 	EXPN     = "EXPN"
-	SIZE     = "SIZE"
 	STARTTLS = "STARTTLS"
 
 	EHLO = "EHLO"
 	HELO = "HELO"
+	LHLO = "LHLO"
 	MAIL = "MAIL"
 	RCPT = "RCPT"
 	DATA = "DATA"
+	BDAT = "BDAT"
+
+	AUTH = "AUTH"
+	RSET = "RSET"
+	NOOP = "NOOP"
+	QUIT = "QUIT"
+)
 
-	AUTH          = "AUTH"
-	RSET          = "RSET"
-	NOOP          = "NOOP"
-	QUIT          = "QUIT"
-	EIGHT_BITMIME = "8BITMIME"
+// EHLO keywords of extensions which aren't commands
+const (
+	SIZE                = "SIZE"
+	EIGHT_BITMIME       = "8BITMIME"
+	SMTPUTF8            = "SMTPUTF8"
+	PIPELINING          = "PIPELINING"
+	ENHANCEDSTATUSCODES = "ENHANCEDSTATUSCODES"
+	CHUNKING            = "CHUNKING"
+	BINARYMIME          = "BINARYMIME"
+)
+
+// BODY parameter of MAIL
+const (
+	BODY = "BODY"
+
+	Body7Bit       = "7BIT"
+	Body8BitMIME   = "8BITMIME"
+	BodyBinaryMIME = "BINARYMIME"
 )
 
 type command struct {
-	isExt bool
 	state int
+	// capability is the EHLO keyword of the extension which defines the command,
+	// command is not implemented if the extension is disabled, otherwise
+	// handler replies if the extension isn't available to the session
+	capability string
 }
 
 var commands = map[string]command{
-	HELP:     command{true, stateNone},
-	VRFY:     command{true, stateNone},
-	EXPN:     command{true, stateNone},
-	SIZE:     command{true, stateNone},
-	STARTTLS: command{true, stateNone},
-	AUTH:     command{true, stateExpectCmdAuth},
-
-	HELO: command{false, stateNone},
-	EHLO: command{false, stateNone},
-	MAIL: command{false, stateExpectCmdMail},
-	RCPT: command{false, stateExpectCmdRcpt},
-	DATA: command{false, stateExpectCmdData},
-
-	RSET: command{false, stateNone},
-	NOOP: command{false, stateNone},
-	QUIT: command{false, stateNone},
-}
-
-// supported extensions
-var ext = func() []string {
-	s := []string{}
-	for name, cmd := range commands {
-		if cmd.isExt {
-			s = append(s, name)
-		}
-	}
-	sort.Strings(s)
-	return s
-}()
-
-var extString = func() string {
-	buf := bytes.NewBufferString("")
-	for i, e := range ext {
-		if i+1 == len(ext) {
-			buf.WriteString("250 ")
-		} else {
-			buf.WriteString("250-")
-		}
-		buf.WriteString(e)
-		buf.WriteString(crlf)
-	}
-	return buf.String()
-}()
+	HELP:     command{state: stateNone, capability: HELP},
+	VRFY:     command{state: stateNone, capability: VRFY},
+	EXPN:     command{state: stateNone},
+	STARTTLS: command{state: stateNone, capability: STARTTLS},
+	AUTH:     command{state: stateExpectCmdAuth, capability: AUTH},
+
+	HELO: command{state: stateNone},
+	EHLO: command{state: stateNone},
+	LHLO: command{state: stateNone},
+	MAIL: command{state: stateExpectCmdMail},
+	RCPT: command{state: stateExpectCmdRcpt},
+	DATA: command{state: stateExpectCmdData},
+	// BDAT checks state itself since the chunk must be consumed anyway
+	BDAT: command{state: stateNone, capability: CHUNKING},
+
+	RSET: command{state: stateNone},
+	NOOP: command{state: stateNone},
+	QUIT: command{state: stateNone},
+}
 
 //---------
 // session
@@ -106,23 +104,54 @@ var extString = func() string {
 type session struct {
 	id         uint64
 	svr        *Server
+	policy     *Policy
 	nativeConn net.Conn
 	conn       *textproto.Conn
 
+	// accepted connection under TLS, used by server to interrupt session
+	rawConn net.Conn
+
+	// whether the session is waiting for a command, accessed atomically
+	idle int32
+
 	// whether the session is using TLS
 	tls bool
 
+	// negotiated TLS parameters, nil before handshake
+	tlsState *tls.ConnectionState
+
 	// auth buffer
 	auth []byte
 
-	// reverse-path buffer
+	// SASL mechanism in progress
+	sasl saslServer
+
+	// authenticated mailbox
+	user *mail.Address
+
+	// domain or address literal of client sent by HELO or EHLO
+	helo string
+
+	// whether the client greeted by EHLO or LHLO
+	extended bool
+
+	// reverse-path buffer, nil for null reverse-path
 	from *mail.Address
 
+	// ESMTP parameters of MAIL
+	mailParams esmtpParams
+
 	// forward-path buffer
 	tos []*mail.Address
 
-	// data buffer
-	data *bytes.Buffer
+	// ESMTP parameters of RCPT, parallel to tos
+	rcptParams []esmtpParams
+
+	// data buffer, spooled to disk if it grows large
+	data *spool
+
+	// time when mail data terminated, zero if replied already
+	dataTerminated time.Time
 
 	// current state
 	state int
@@ -131,16 +160,21 @@ type session struct {
 	errCount int
 }
 
-func newSession(svr *Server, conn net.Conn) *session {
+func newSession(svr *Server, conn net.Conn, policy *Policy) *session {
 	s := new(session)
 	s.svr = svr
+	s.policy = policy
 	s.nativeConn = conn
 	s.conn = textproto.NewConn(conn)
+	s.rawConn = conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		s.rawConn = tlsConn.NetConn()
+	}
 	s.state = stateReady
 
 	// init buffer
 	s.auth = []byte{}
-	s.data = bytes.NewBufferString("")
+	s.data = newSpool(etc.Conf().SpoolDir, etc.Conf().SpoolThreshold)
 	s.tos = []*mail.Address{}
 
 	return s
@@ -153,22 +187,54 @@ func (s *session) setState(state int) {
 
 func (s *session) quit() {
 	s.svr.removeSession(s.id)
+	s.data.Reset()
+	s.flush()
 	s.conn.Close()
 }
 
 func (s *session) run() {
-	s.conn.PrintfLine("%3d %s", CodeServiceReady, etc.Conf().S_ServiceInfo)
+	debug.Debugf("session %d connected from %v", s.id, s.nativeConn.RemoteAddr())
+	// handshake of implicit TLS before greeting
+	if tlsConn, ok := s.nativeConn.(*tls.Conn); ok {
+		s.nativeConn.SetDeadline(deadline(seconds(etc.Conf().GreetingTimeout)))
+		if err := s.handshake(tlsConn); err != nil {
+			s.quit()
+			return
+		}
+	}
+	s.responseGreeting()
+	timeout := seconds(etc.Conf().GreetingTimeout)
 	for {
-		if s.errCount >= etc.Conf().MaxErrorSize {
+		if s.errCount >= s.policy.maxErrors() {
+			s.quit()
+			return
+		}
+		// RFC2920 3.2: replies are sent when there is no more command
+		// received, or the client may wait forever
+		if !s.hasPendingCommand() {
+			if err := s.flush(); err != nil {
+				debug.Debugf("session %d write error: %v", s.id, err)
+				s.quit()
+				return
+			}
+		}
+		s.setReadTimeout(timeout)
+		// server interrupts idle sessions by read deadline when shutting
+		// down, so shutdown must be checked after idle marked
+		atomic.StoreInt32(&s.idle, 1)
+		if s.svr.shuttingDown() {
+			s.responseShutdown()
 			s.quit()
 			return
 		}
 		line, err := s.conn.ReadLine()
 		if err != nil {
-			debug.Debugf("session %d read error: %v", s.id, err)
+			s.onReadError(err)
 			s.quit()
 			return
 		}
+		atomic.StoreInt32(&s.idle, 0)
+		timeout = s.commandTimeout()
 
 		var (
 			quit  bool
@@ -177,11 +243,8 @@ func (s *session) run() {
 
 		debug.Debugf("session %d state: %x", s.id, s.state)
 		switch s.state {
-		case stateMailInput:
-			quit = s.appendData(line)
-
 		case stateAuth:
-			//quit = s.auth(line)
+			quit = s.onAuthResponse(line)
 
 		default:
 			isCmd = true
@@ -213,6 +276,10 @@ func (s *session) run() {
 	}
 }
 
+func (s *session) isIdle() bool {
+	return atomic.LoadInt32(&s.idle) != 0
+}
+
 func (s *session) isExpectedCmd(cmd command) bool {
 	return cmd.state == stateNone || (s.state&cmd.state) != 0
 }
@@ -223,7 +290,7 @@ func (s *session) dispatch(cmdName, args string) (quit bool) {
 	}
 	debug.Debugf("session %d recv command: %q, args: %q", s.id, cmdName, args)
 	cmd, ok := commands[cmdName]
-	if !ok {
+	if !ok || (cmd.capability != "" && isExtensionDisabled(cmd.capability)) {
 		s.commandNotImplemented(cmdName)
 		return
 	}
@@ -231,6 +298,15 @@ func (s *session) dispatch(cmdName, args string) (quit bool) {
 		s.responseBadSequence()
 		return
 	}
+	if !s.tls && s.requiresTLS(cmdName) {
+		s.responseTLSRequired()
+		return
+	}
+	// RFC2033 4.1: LMTP uses LHLO instead of HELO and EHLO
+	if (cmdName == LHLO) != s.policy.LMTP && (cmdName == LHLO || cmdName == HELO || cmdName == EHLO) {
+		s.commandNotImplemented(cmdName)
+		return
+	}
 	switch cmdName {
 	case NOOP:
 		s.onNoOp()
@@ -255,7 +331,7 @@ func (s *session) dispatch(cmdName, args string) (quit bool) {
 
 	case HELO:
 		s.onHelo(args)
-	case EHLO:
+	case EHLO, LHLO:
 		s.onEhlo(args)
 
 	case AUTH:
@@ -270,76 +346,131 @@ func (s *session) dispatch(cmdName, args string) (quit bool) {
 	case DATA:
 		quit = s.onData(args)
 
+	case BDAT:
+		quit = s.onBdat(args)
+
 	default:
 		s.commandNotImplemented(cmdName)
 	}
 	return quit
 }
 
+// requiresTLS reports whether the command is rejected before STARTTLS
+func (s *session) requiresTLS(cmdName string) bool {
+	switch cmdName {
+	case AUTH:
+		return s.policy.tlsRequirement() >= TLSBeforeAuth
+	case MAIL:
+		return s.policy.tlsRequirement() >= TLSBeforeMail
+	}
+	return false
+}
+
 func (s *session) commandNotImplemented(cmd string) {
 	s.responseCommandNotImplemented(cmd)
 }
 
-func (s *session) appendData(args string) (quit bool) {
-	if args == "." {
-		return s.complete()
+// readData streams mail data into data buffer until the terminator,
+// exactly one reply is sent after the whole mail data received
+func (s *session) readData() (quit bool) {
+	var (
+		mail = newDataReader(s.conn.R)
+		dr   = s.newTimeoutReader(mail,
+			seconds(etc.Conf().DataInitTimeout), seconds(etc.Conf().DataBlockTimeout))
+		maxSize = int64(s.policy.maxMessageSize())
+		limit   = maxSize + 1
+	)
+	if maxSize <= 0 {
+		// no fixed maximum message size
+		limit = math.MaxInt64
+	}
+	defer s.reset()
+	n, err := io.CopyN(s.data, dr, limit)
+	if s.data.err != nil {
+		// failed to spool, discard the rest and reject the mail
+		debug.Debugf("session %d spool error: %v", s.id, s.data.err)
+		if err = drain(dr); err == nil {
+			s.responseInsufficientStorage()
+			return
+		}
+	} else if err == nil && maxSize > 0 && n > maxSize {
+		// too large, discard the rest and reject the mail
+		if err = drain(dr); err == nil {
+			s.responseExceededStorage()
+			return
+		}
 	}
-	if s.data.Len()+len(args) > etc.Conf().MaxBufferSize {
-		s.responseExceededStorage()
+	if err != nil && err != io.EOF {
+		s.onReadError(err)
+		return true
+	}
+	if mail.bareLF {
+		s.responseBareLF()
 		return
 	}
-	s.data.WriteString(args)
-	s.data.WriteString(crlf)
-	s.responseOK()
-	return
+	s.dataTerminated = time.Now()
+	return s.complete()
 }
 
 func (s *session) complete() (quit bool) {
-	if s.from == nil || s.tos == nil || len(s.tos) == 0 {
-		s.responseBadSequence()
-		return
-	}
-	buf := bytes.NewBufferString("")
-	for i, to := range s.tos {
-		if i != 0 {
-			buf.WriteByte(',')
-		}
-		buf.WriteString(to.String())
-	}
-
-	var (
-		fromAddrStr  = s.from.String()
-		toAddrStr    = buf.String()
-		mailData     = s.data.Bytes()
-		serverDomain = etc.Conf().DomainName
-		allowDelay   = etc.Conf().AllowDelay
-	)
-
+	env := s.envelope()
+	header := s.mailHeader()
 	for _, to := range s.tos {
-		toDomain := parseDomainFromAddress(to.Address)
-		if toDomain != serverDomain {
-			// delay mail
-			fromDomain := parseDomainFromAddress(s.from.Address)
-			if fromDomain != serverDomain && !aAllowDelay {
-				//TODO: handle the error
-				debug.Debugf("cannot delay mail")
+		var err error
+		if toDomain := parseDomainFromAddress(to.Address); isLocalDomain(toDomain) {
+			err = s.svr.repo.SaveEmail(to, env, s.mailReader(header))
+		} else {
+			// relay is checked by RCPT
+			debug.Debugf("delay mail ...")
+			delayMail(toDomain, env, to.Address, s.mailReader(header))
+		}
+		if s.policy.LMTP {
+			// RFC2033 4.2: one reply for each successful RCPT command
+			if err != nil {
+				s.responseRecipientLocalError(to.Address)
 			} else {
-				debug.Debugf("delay mail ...")
-				delayMail(toDomain, fromAddrStr, to.Address, mailData)
+				s.responseRecipientDelivered(to.Address)
 			}
 			continue
 		}
-
-		err := s.svr.repo.SaveEmail(to, fromAddrStr, toAddrStr, mailData)
 		if err != nil {
 			s.responseLocalError()
 			return
 		}
 	}
-	s.responseOK()
+	if !s.policy.LMTP {
+		s.responseOK()
+	}
 	return
 }
 
+// envelope returns envelope of current mail transaction
+func (s *session) envelope() *Envelope {
+	env := &Envelope{
+		To:   make([]Recipient, 0, len(s.tos)),
+		Body: Body7Bit,
+	}
+	if s.from != nil {
+		env.From = s.from.Address
+	}
+	for i, to := range s.tos {
+		rcpt := Recipient{
+			Address: to.Address,
+			ORcpt:   s.rcptParams[i][ORCPT],
+		}
+		rcpt.Notify, _ = parseNotify(s.rcptParams[i][NOTIFY])
+		env.To = append(env.To, rcpt)
+	}
+	if body, ok := s.mailParams[BODY]; ok {
+		env.Body = strings.ToUpper(body)
+	}
+	_, env.SMTPUTF8 = s.mailParams[SMTPUTF8]
+	env.TLS = s.tlsState
+	env.Ret = strings.ToUpper(s.mailParams[RET])
+	env.EnvID = s.mailParams[ENVID]
+	return env
+}
+
 func parseDomainFromAddress(address string) string {
 	index := strings.Index(address, "@")
 	if index >= 0 {
@@ -354,27 +485,31 @@ func parseDomainFromAddress(address string) string {
 
 // HELP
 func (s *session) onHelp(args string) {
-	s.printf("%3d https://tools.ietf.org/html/rfc5321", CodeHelpMessage)
+	s.responseHelp()
 }
 
 // HELO
 func (s *session) onHelo(args string) {
-	if len(args) > 0 {
-		s.responseOK()
-		s.setState(stateExpectCmdMail | stateExpectCmdAuth)
-	} else {
-		s.responseSyntaxError()
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		s.responseErrorInParameter()
+		return
 	}
+	s.helo, s.extended = fields[0], false
+	s.responseHelo()
+	s.setState(stateExpectCmdMail | stateExpectCmdAuth)
 }
 
 // EHLO
 func (s *session) onEhlo(args string) {
-	if len(args) > 0 {
-		s.printf(extString)
-		s.setState(stateExpectCmdMail | stateExpectCmdAuth)
-	} else {
-		s.responseSyntaxError()
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		s.responseErrorInParameter()
+		return
 	}
+	s.helo, s.extended = fields[0], true
+	s.responseEhlo(s.extensions())
+	s.setState(stateExpectCmdMail | stateExpectCmdAuth)
 }
 
 // NOOP
@@ -395,7 +530,7 @@ func (s *session) onVrfy(args string) {
 		s.responseVrfy(addr.String())
 		return
 	}
-	s.responseUserNotLocal()
+	s.responseMailboxNotFound()
 }
 
 // RSET
@@ -415,30 +550,97 @@ func (s *session) onRset(args string) {
 
 func (s *session) reset() {
 	s.from = nil
+	s.mailParams = nil
 	s.tos = s.tos[0:0]
+	s.rcptParams = s.rcptParams[0:0]
 	s.auth = s.auth[0:0]
+	s.sasl = nil
 	s.data.Reset()
 	s.setState(stateExpectCmdMail | stateExpectCmdAuth)
 }
 
 // STARTTLS
+// RFC3207 4.2:
+// "Upon completion of the TLS handshake, the SMTP protocol is reset to
+// the initial state (the state in SMTP after a server issues a 220
+// service ready greeting).  The server MUST discard any knowledge
+// obtained from the client, such as the argument to the EHLO command,
+// which was not obtained from the TLS negotiation itself."
 func (s *session) onStartTLS(args string) (quit bool) {
-	if s.svr.tlsConfig == nil {
+	if s.svr.tlsConfig == nil || s.policy.DisableStartTLS {
 		s.commandNotImplemented(STARTTLS)
 		return
 	}
+	if args != "" {
+		s.responseErrorInParameter()
+		return
+	}
+	if s.tls {
+		s.responseBadSequence()
+		return
+	}
+	s.responseReadyToStartTLS()
+	if err := s.flush(); err != nil {
+		return true
+	}
+	// commands pipelined after STARTTLS were sent in plaintext and may
+	// be injected by an attacker, they are discarded with the old reader
+	if n := s.conn.R.Buffered(); n > 0 {
+		debug.Debugf("session %d discard %d bytes received before TLS handshake", s.id, n)
+	}
 	tlsConn := tls.Server(s.nativeConn, s.svr.tlsConfig)
+	tlsConn.SetDeadline(deadline(s.commandTimeout()))
+	if err := s.handshake(tlsConn); err != nil {
+		return true
+	}
 	s.nativeConn = tlsConn
 	s.conn = textproto.NewConn(tlsConn)
-	s.tls = true
 	s.reset()
-	s.responseOK()
+	s.user = nil
+	s.helo, s.extended = "", false
+	s.setState(stateReady)
 	return
 }
 
+// handshake performs TLS handshake and records the connection state
+func (s *session) handshake(tlsConn *tls.Conn) error {
+	if err := tlsConn.Handshake(); err != nil {
+		debug.Debugf("session %d TLS handshake error: %v", s.id, err)
+		return err
+	}
+	state := tlsConn.ConnectionState()
+	s.tls = true
+	s.tlsState = &state
+	debug.Debugf("session %d TLS established: version %s, cipher %s", s.id,
+		tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	if cert := s.peerCertificate(); cert != nil {
+		debug.Debugf("session %d client certificate: %s", s.id, cert.Subject)
+	}
+	return nil
+}
+
+// peerCertificate returns certificate of client, nil if client sent none
+func (s *session) peerCertificate() *x509.Certificate {
+	if s.tlsState == nil || len(s.tlsState.PeerCertificates) == 0 {
+		return nil
+	}
+	return s.tlsState.PeerCertificates[0]
+}
+
 // AUTH
+// RFC4954 4:
+// "After an AUTH command has been successfully completed, no more AUTH
+// commands may be issued in the same session."
 func (s *session) onAuth(args string) (quit bool) {
-	s.commandNotImplemented(AUTH)
+	if len(s.authMechanisms()) == 0 {
+		s.commandNotImplemented(AUTH)
+		return
+	}
+	if s.user != nil {
+		s.responseBadSequence()
+		return
+	}
+	s.startAuth(args)
 	return
 }
 
@@ -448,20 +650,41 @@ func (s *session) onAuth(args string) (quit bool) {
 // and the mail data buffer, and it inserts the reverse-path information
 // from its argument clause into the reverse-path buffer."
 func (s *session) onMail(args string) (quit bool) {
-	matchResult := fromRegexp.FindStringSubmatch(args)
-	if matchResult == nil || len(matchResult) != 2 {
-		s.responsePermMailRcptParameterError()
-		return
-	}
-	if addr, err := mail.ParseAddress(matchResult[1]); err != nil {
-		s.responsePermMailRcptParameterError()
-	} else {
-		s.from = addr
-		s.tos = s.tos[0:0]
-		s.data.Reset()
-		s.setState(stateExpectCmdRcpt)
-		s.responseOK()
+	if r := s.checkAuthRequired(); r != nil {
+		s.reply(r)
+		return
+	}
+	path, params, err := parsePathArgs(args, "FROM:")
+	if err != nil {
+		s.responseSenderPathError(err)
+		return
+	}
+	mailParams, err := s.parseParams(params, mailParamHandlers)
+	if err != nil {
+		s.responseParamError(err)
+		return
+	}
+	_, utf8 := mailParams[SMTPUTF8]
+	addr, err := parseReversePath(path, utf8)
+	if err != nil {
+		s.responseSenderPathError(err)
+		return
+	}
+	from := ""
+	if addr != nil {
+		from = addr.Address
 	}
+	if r := s.checkSender(from); r != nil {
+		s.reply(r)
+		return
+	}
+	s.from = addr
+	s.mailParams = mailParams
+	s.tos = s.tos[0:0]
+	s.rcptParams = s.rcptParams[0:0]
+	s.data.Reset()
+	s.setState(stateExpectCmdRcpt)
+	s.responseSenderOK()
 	return
 }
 
@@ -471,34 +694,130 @@ func (s *session) onMail(args string) (quit bool) {
 // buffer; it does not change the reverse-path buffer nor the mail data
 // buffer."
 func (s *session) onRcpt(args string) (quit bool) {
-	matchResult := toRegexp.FindStringSubmatch(args)
-	if matchResult == nil || len(matchResult) != 2 {
-		s.responsePermMailRcptParameterError()
+	path, params, err := parsePathArgs(args, "TO:")
+	if err != nil {
+		s.responseRecipientPathError(err)
+		return
+	}
+	rcptParams, err := s.parseParams(params, rcptParamHandlers)
+	if err != nil {
+		s.responseParamError(err)
 		return
 	}
-	addr, err := mail.ParseAddress(matchResult[1])
+	_, utf8 := s.mailParams[SMTPUTF8]
+	addr, err := parseForwardPath(path, utf8)
 	if err != nil {
-		s.responsePermMailRcptParameterError()
+		s.responseRecipientPathError(err)
 		return
 	}
-	if len(s.tos) >= etc.Conf().MaxRecipients {
+	if isLocalDomain(parseDomainFromAddress(addr.Address)) {
+		mailbox, ok := s.svr.repo.FindMailbox(addr.Address)
+		if !ok {
+			s.responseMailboxNotFound()
+			return
+		}
+		addr = mailbox
+	} else if !s.relayAllowed() {
+		s.responseRelayDenied()
+		return
+	}
+	if len(s.tos) >= s.policy.maxRecipients() {
 		s.responseTooManyRecipients()
 		return
 	}
-	s.responseOK()
+	s.responseRecipientOK()
 	s.tos = append(s.tos, addr)
+	s.rcptParams = append(s.rcptParams, rcptParams)
 	s.setState(stateExpectCmdData | stateExpectCmdRcpt)
 	return
 }
 
 // DATA
+// RFC5321 4.1.1.4:
+// "The receiver normally sends a 354 response to DATA, and then treats
+// the lines (strings ending in <CRLF> sequences, as described in
+// Section 2.3.7) following the command as mail data from the sender."
 func (s *session) onData(args string) (quit bool) {
 	if args != "" {
 		s.responseErrorInParameter()
 		return
 	}
+	if len(s.tos) == 0 {
+		s.responseBadSequence()
+		return
+	}
+	// RFC3030 3: BINARYMIME mail must be sent by BDAT
+	if strings.EqualFold(s.mailParams[BODY], BodyBinaryMIME) {
+		s.responseBadSequence()
+		return
+	}
 	s.responseStartMailInput()
+	if err := s.flush(); err != nil {
+		return true
+	}
 	s.setState(stateMailInput)
+	return s.readData()
+}
+
+// BDAT
+// RFC3030 2:
+// "The BDAT verb takes two arguments.  The first argument indicates the
+// length, in octets, of the binary data chunk.  The second optional
+// argument indicates that the data chunk is the last."
+func (s *session) onBdat(args string) (quit bool) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 {
+		s.responseErrorInParameter()
+		return
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		s.responseErrorInParameter()
+		return
+	}
+	// the chunk must be consumed whatever the reply is
+	last := len(fields) == 2
+	if last && !strings.EqualFold(fields[1], "LAST") {
+		return s.discardChunk(size, s.responseErrorInParameter)
+	}
+	if s.state&(stateExpectCmdData|stateChunking) == 0 || len(s.tos) == 0 {
+		return s.discardChunk(size, s.responseBadSequence)
+	}
+	// compared without sum which may overflow, no limit if the maximum is 0
+	if maxSize := int64(s.policy.maxMessageSize()); maxSize > 0 && size > maxSize-s.data.Len() {
+		s.reset()
+		return s.discardChunk(size, s.responseExceededStorage)
+	}
+
+	blockTimeout := seconds(etc.Conf().DataBlockTimeout)
+	chunk := &io.LimitedReader{R: s.newTimeoutReader(s.conn.R, blockTimeout, blockTimeout), N: size}
+	if _, err := io.Copy(s.data, chunk); err != nil {
+		if s.data.err == nil {
+			s.onReadError(err)
+			return true
+		}
+		debug.Debugf("session %d spool error: %v", s.id, s.data.err)
+		s.reset()
+		return s.discardChunk(chunk.N, s.responseInsufficientStorage)
+	}
+	if !last {
+		s.setState(stateChunking)
+		s.responseChunkReceived(size)
+		return
+	}
+	defer s.reset()
+	s.dataTerminated = time.Now()
+	return s.complete()
+}
+
+// discardChunk discards size bytes of BDAT chunk then sends the reply
+func (s *session) discardChunk(size int64, reply func()) (quit bool) {
+	blockTimeout := seconds(etc.Conf().DataBlockTimeout)
+	if _, err := io.CopyN(ioutil.Discard, s.newTimeoutReader(s.conn.R, blockTimeout, blockTimeout), size); err != nil {
+		s.onReadError(err)
+		return true
+	}
+	reply()
 	return
 }
 
@@ -516,68 +835,187 @@ func (s *session) onQuit(args string) bool {
 // response
 //----------
 
+func (s *session) responseGreeting() {
+	s.reply(newReply(CodeServiceReady, "", etc.Conf().DomainName+" "+etc.Conf().S_ServiceInfo))
+}
+
+func (s *session) responseReadyToStartTLS() {
+	s.reply(newReply(CodeServiceReady, EnhOK, "Ready to start TLS"))
+}
+
+func (s *session) responseTLSRequired() {
+	s.reply(newReply(CodeAuthRequired, EnhSecurityPolicy, "Must issue a STARTTLS command first"))
+}
+
 func (s *session) responseOK() {
-	s.printf("%3d OK", CodeOK)
+	s.reply(newReply(CodeOK, EnhOK, "OK"))
+}
+
+func (s *session) responseHelo() {
+	s.reply(newReply(CodeOK, "", etc.Conf().DomainName))
+}
+
+func (s *session) responseEhlo(exts []string) {
+	s.reply(newReply(CodeOK, "", append([]string{etc.Conf().DomainName}, exts...)...))
+}
+
+func (s *session) responseHelp() {
+	s.reply(newReply(CodeHelpMessage, EnhOK, "https://tools.ietf.org/html/rfc5321"))
 }
 
 func (s *session) responseQuit() {
-	s.printf("%3d bye", CodeServiceClosing)
+	s.reply(newReply(CodeServiceClosing, EnhOK, "bye"))
 }
 
-func (s *session) responsePermMailRcptParameterError() {
-	s.errCount++
-	s.printf("%3d mail/rcpt parameter syntax error", CodePermMailRcptParameterError)
+func (s *session) responseSenderOK() {
+	s.reply(newReply(CodeOK, EnhSenderOK, "sender OK"))
+}
+
+func (s *session) responseRecipientOK() {
+	s.reply(newReply(CodeOK, EnhDestinationValid, "recipient OK"))
 }
 
 func (s *session) responseSyntaxError() {
 	s.errCount++
-	s.printf("%3d syntax error", CodeSyntaxError)
+	s.reply(newReply(CodeSyntaxError, EnhSyntaxError, "syntax error"))
 }
 
 func (s *session) responseErrorInParameter() {
 	s.errCount++
-	s.printf("%3d syntax error", CodeSyntaxErrorInParametersOrArguments)
+	s.reply(newReply(CodeSyntaxErrorInParametersOrArguments, EnhInvalidArguments, "syntax error in parameters"))
 }
 
 func (s *session) responseCommandNotImplemented(cmd string) {
 	s.errCount++
-	s.printf("%3d command %q not implemented", CodePermCommandNotImplemented, cmd)
+	s.reply(newReplyf(CodePermCommandNotImplemented, EnhInvalidCommand, "command %q not implemented", cmd))
 }
 
 func (s *session) responseBadSequence() {
 	s.errCount++
-	s.printf("%3d bad sequence of commands", CodePermBadSequenceOfCommands)
+	s.reply(newReply(CodePermBadSequenceOfCommands, EnhInvalidCommand, "bad sequence of commands"))
+}
+
+func (s *session) responseAuthChallenge(challenge string) {
+	s.reply(newReply(CodeAuthContinue, "", challenge))
+}
+
+func (s *session) responseAuthSucceeded() {
+	s.reply(newReply(CodeAuthSucceeded, EnhAuthSucceeded, "authentication successful"))
+}
+
+func (s *session) responseAuthInvalid() {
+	// failed attempts are limited as errors, or passwords may be guessed
+	s.errCount++
+	s.reply(newReply(CodeAuthInvalid, EnhAuthCredentialsInvalid, "authentication credentials invalid"))
+}
+
+func (s *session) responseAuthTempFailure() {
+	s.reply(newReply(CodeTempAuthFailure, EnhTempAuthFailure, "temporary authentication failure"))
+}
+
+func (s *session) responseAuthMechanismNotSupported() {
+	s.reply(newReply(CodePermCommandParameterNotImplemented, EnhInvalidArguments, "unrecognized authentication type"))
 }
 
 func (s *session) responseStartMailInput() {
-	s.printf("%3d start mail input", CodeStartMailInput)
+	s.reply(newReply(CodeStartMailInput, "", "start mail input; end with <CRLF>.<CRLF>"))
+}
+
+func (s *session) responseChunkReceived(size int64) {
+	s.reply(newReplyf(CodeOK, EnhOK, "%d octets received", size))
 }
 
 func (s *session) responseVrfy(addr string) {
-	s.printf("%3d %s", CodeOK, addr)
+	s.reply(newReply(CodeOK, EnhDestinationValid, addr))
+}
+
+func (s *session) responseMailboxNotFound() {
+	s.reply(newReply(CodePermMailboxUnavailable, EnhBadDestinationMailbox, "mailbox unavailable"))
+}
+
+func (s *session) responseRecipientDelivered(addr string) {
+	s.reply(newReplyf(CodeOK, EnhOK, "<%s> delivered", addr))
+}
+
+func (s *session) responseRecipientLocalError(addr string) {
+	s.reply(newReplyf(CodeLocalErrorInProcessing, EnhTempLocalError, "<%s> save email error", addr))
 }
 
-func (s *session) responseUserNotLocal() {
-	s.printf("%3d user not local", CodeUserNotLocal)
+func (s *session) responseRelayDenied() {
+	s.reply(newReply(CodePermMailboxUnavailable, EnhNotAuthorized, "relay access denied"))
 }
 
 func (s *session) responseTooManyRecipients() {
 	s.errCount++
-	s.printf("%3d too many recipients", CodeInsufficientSystemStorage)
+	s.reply(newReply(CodeInsufficientSystemStorage, EnhTooManyRecipients, "too many recipients"))
 }
 
 func (s *session) responseExceededStorage() {
 	s.errCount++
-	s.printf("%3d exceeded storage", CodePermExceededStorageAllocation)
+	s.reply(newReply(CodePermExceededStorageAllocation, EnhMessageTooBig, "message size exceeds fixed maximum message size"))
 }
 
-func (s *session) responseLocalError() {
+func (s *session) responseBareLF() {
+	s.errCount++
+	s.reply(newReply(CodePermTransactionFailed, EnhSyntaxError, "bare LF not allowed in mail data"))
+}
+
+func (s *session) responseSenderPathError(err error) {
+	s.errCount++
+	s.reply(newReplyf(CodeSyntaxErrorInParametersOrArguments, EnhBadSenderSyntax, "%v", err))
+}
+
+func (s *session) responseRecipientPathError(err error) {
 	s.errCount++
-	s.printf("%3d save email error", CodeLocalErrorInProcessing)
+	s.reply(newReplyf(CodeSyntaxErrorInParametersOrArguments, EnhBadDestinationSyntax, "%v", err))
+}
+
+func (s *session) responseParamError(err error) {
+	s.errCount++
+	if r, ok := err.(*reply); ok {
+		s.reply(r)
+		return
+	}
+	s.reply(newReplyf(CodeSyntaxErrorInParametersOrArguments, EnhInvalidArguments, "%v", err))
+}
+
+func (s *session) responseInsufficientStorage() {
+	s.reply(newReply(CodeInsufficientSystemStorage, EnhTempSystemFull, "insufficient system storage"))
 }
 
-func (s *session) printf(format string, args ...interface{}) {
-	resp := fmt.Sprintf(format, args...)
-	debug.Debugf("resp: %s", resp)
-	s.conn.PrintfLine(resp)
+func (s *session) responseShutdown() {
+	s.reply(newReply(CodeServiceNotAvailable, EnhTempSystemNotAccepting, "service shutting down, closing connection"))
+}
+
+func (s *session) responseTimeout() {
+	s.reply(newReply(CodeServiceNotAvailable, EnhTempBadConnection, "timeout exceeded, closing connection"))
+}
+
+func (s *session) responseLocalError() {
+	s.reply(newReply(CodeLocalErrorInProcessing, EnhTempLocalError, "save email error"))
+}
+
+// reply buffers the reply, buffered replies are sent by flush
+func (s *session) reply(r *reply) {
+	for _, line := range r.format() {
+		debug.Debugf("session %d resp: %s", s.id, line)
+		s.conn.W.WriteString(line)
+		s.conn.W.WriteString(crlf)
+	}
+}
+
+func (s *session) flush() error {
+	s.nativeConn.SetWriteDeadline(s.writeDeadline())
+	return s.conn.W.Flush()
+}
+
+// hasPendingCommand reports whether a whole command line has been
+// received but not read yet, i.e. client is pipelining
+func (s *session) hasPendingCommand() bool {
+	n := s.conn.R.Buffered()
+	if n == 0 {
+		return false
+	}
+	buf, err := s.conn.R.Peek(n)
+	return err == nil && bytes.IndexByte(buf, '\n') >= 0
 }
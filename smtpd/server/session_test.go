@@ -0,0 +1,440 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mkideal/cmail/smtpd/etc"
+)
+
+const testConfig = `
+domain_name: example.com
+max_error_size: 3
+max_recipients: 100
+spool_threshold: 65536
+`
+
+// testConfigVersion is used as modification time of config file, which
+// is loaded only if modified
+var testConfigVersion int64
+
+// loadTestConfig loads testConfig followed by extra settings
+func loadTestConfig(extra string) error {
+	f, err := ioutil.TempFile("", "smtpd-test-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(testConfig + extra)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	testConfigVersion++
+	if err := os.Chtimes(f.Name(), time.Now(), time.Unix(testConfigVersion, 0)); err != nil {
+		return err
+	}
+	return etc.LoadConfig(f.Name(), nil)
+}
+
+func TestMain(m *testing.M) {
+	if err := loadTestConfig(""); err != nil {
+		fmt.Fprintf(os.Stderr, "load config: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// testRepository holds mailboxes of example.com, saving mail to broken
+// always fails
+type testRepository struct {
+	locker sync.Mutex
+	mails  map[string][]string
+}
+
+func newTestRepository() *testRepository {
+	return &testRepository{mails: make(map[string][]string)}
+}
+
+func (repo *testRepository) FindMailbox(usernameOrAddress string) (*mail.Address, bool) {
+	name := strings.TrimSuffix(usernameOrAddress, "@example.com")
+	switch name {
+	case "alice", "bob", "broken":
+		return &mail.Address{Name: name, Address: name + "@example.com"}, true
+	}
+	return nil, false
+}
+
+func (repo *testRepository) SaveEmail(addr *mail.Address, env *Envelope, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if addr.Name == "broken" {
+		return errors.New("broken mailbox")
+	}
+	repo.locker.Lock()
+	defer repo.locker.Unlock()
+	repo.mails[addr.Address] = append(repo.mails[addr.Address], string(data))
+	return nil
+}
+
+func (repo *testRepository) mail(address string, i int) string {
+	repo.locker.Lock()
+	defer repo.locker.Unlock()
+	if i >= len(repo.mails[address]) {
+		return ""
+	}
+	return repo.mails[address][i]
+}
+
+// newTestTLSConfig returns config with a self-signed certificate
+func newTestTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// testClient is the client side of a session running over net.Pipe
+type testClient struct {
+	t *testing.T
+	*textproto.Conn
+	conn net.Conn
+	done chan struct{}
+}
+
+func newTestSession(t *testing.T, svr *Server, policy *Policy) *testClient {
+	client, conn := net.Pipe()
+	s := newSession(svr, conn, policy)
+	c := &testClient{t: t, Conn: textproto.NewConn(client), conn: client, done: make(chan struct{})}
+	go func() {
+		s.run()
+		close(c.done)
+	}()
+	t.Cleanup(func() { c.Close() })
+	c.expect(CodeServiceReady)
+	return c
+}
+
+// send writes lines at once, so that they are pipelined
+func (c *testClient) send(lines ...string) {
+	c.t.Helper()
+	c.write(strings.Join(lines, crlf) + crlf)
+}
+
+// write writes raw data, e.g. commands followed by BDAT chunks
+func (c *testClient) write(data string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.W, data); err != nil {
+		c.t.Fatalf("write %q: %v", data, err)
+	}
+	if err := c.W.Flush(); err != nil {
+		c.t.Fatalf("write %q: %v", data, err)
+	}
+}
+
+// startTLS performs TLS handshake after 220 reply of STARTTLS, data
+// buffered by the old reader is dropped
+func (c *testClient) startTLS() {
+	c.t.Helper()
+	tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		c.t.Fatalf("TLS handshake: %v", err)
+	}
+	c.Conn = textproto.NewConn(tlsConn)
+	c.conn = tlsConn
+}
+
+// expect reads replies in order, code of 1 or 2 digits matches prefix
+func (c *testClient) expect(codes ...int) {
+	c.t.Helper()
+	for _, code := range codes {
+		if _, msg, err := c.ReadResponse(code); err != nil {
+			c.t.Fatalf("want %d, got %v %s", code, err, msg)
+		}
+	}
+}
+
+// expectClosed checks that the session quits without more replies
+func (c *testClient) expectClosed() {
+	c.t.Helper()
+	if line, err := c.ReadLine(); err != io.EOF {
+		c.t.Fatalf("want closed, got %q, %v", line, err)
+	}
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		c.t.Fatalf("session not quit")
+	}
+}
+
+func TestSessionErrorLimit(t *testing.T) {
+	c := newTestSession(t, New(newTestRepository()), &Policy{MaxErrors: 2})
+	c.send("EHLO client.example.org")
+	c.expect(CodeOK)
+	c.send("MAIL FROM:<sender@example.org>")
+	c.expect(CodeOK)
+	// rejected recipients are not errors of client
+	for i := 0; i < 3; i++ {
+		c.send("RCPT TO:<nobody@example.com>")
+		c.expect(5)
+		c.send("RCPT TO:<someone@example.net>")
+		c.expect(5)
+	}
+	c.send("NOOP")
+	c.expect(CodeOK)
+	c.send("FOO", "RCPT TO:<alice@example.com> FOO=BAR")
+	c.expect(CodePermCommandNotImplemented, 5)
+	c.expectClosed()
+}
+
+func TestAuthFailureLimit(t *testing.T) {
+	svr := New(newTestRepository())
+	svr.SetAuthenticator(testAuthenticator{"alice": "secret"})
+	c := newTestSession(t, svr, &Policy{MaxErrors: 3})
+	c.send("EHLO client.example.org")
+	c.expect(CodeOK)
+	wrong := base64.StdEncoding.EncodeToString([]byte("\x00alice\x00wrong"))
+	for i := 0; i < 3; i++ {
+		c.send("AUTH PLAIN " + wrong)
+		c.expect(CodeAuthInvalid)
+	}
+	c.expectClosed()
+}
+
+func TestHeloWithoutDomain(t *testing.T) {
+	c := newTestSession(t, New(newTestRepository()), &Policy{MaxErrors: 10})
+	c.send("EHLO   ", "HELO \t", "EHLO", "MAIL FROM:<sender@example.org>", "EHLO client.example.org")
+	c.expect(CodeSyntaxErrorInParametersOrArguments, CodeSyntaxErrorInParametersOrArguments,
+		CodeSyntaxErrorInParametersOrArguments, CodePermBadSequenceOfCommands, CodeOK)
+}
+
+func TestStartTLSDiscardsPipelinedCommands(t *testing.T) {
+	svr := New(newTestRepository())
+	svr.tlsConfig = newTestTLSConfig(t)
+	c := newTestSession(t, svr, defaultPolicy)
+	c.send("EHLO client.example.org")
+	c.expect(CodeOK)
+	// MAIL sent in plaintext after STARTTLS may be injected
+	c.send("STARTTLS", "MAIL FROM:<attacker@example.org>")
+	c.expect(CodeServiceReady)
+	c.startTLS()
+	c.send("MAIL FROM:<sender@example.org>")
+	c.expect(CodePermBadSequenceOfCommands)
+	c.send("EHLO client.example.org")
+	c.expect(CodeOK)
+	c.send("MAIL FROM:<sender@example.org>")
+	c.expect(CodeOK)
+}
+
+// startMail starts a transaction to alice
+func (c *testClient) startMail(mailParams string) {
+	c.t.Helper()
+	c.send("EHLO client.example.org", "MAIL FROM:<sender@example.org>"+mailParams, "RCPT TO:<alice@example.com>")
+	c.expect(CodeOK, CodeOK, CodeOK)
+}
+
+func TestPipelining(t *testing.T) {
+	repo := newTestRepository()
+	c := newTestSession(t, New(repo), &Policy{MaxMessageSize: 1024})
+	// replies are sent in order, and 354 is sent without more commands
+	c.send("EHLO client.example.org", "MAIL FROM:<sender@example.org>", "RCPT TO:<alice@example.com>",
+		"RCPT TO:<nobody@example.com>", "DATA")
+	c.expect(CodeOK, CodeOK, CodeOK, CodePermMailboxUnavailable, CodeStartMailInput)
+	c.send("Subject: hi", "", "body", ".", "NOOP")
+	c.expect(CodeOK, CodeOK)
+	if mail := repo.mail("alice@example.com", 0); !strings.HasSuffix(mail, "Subject: hi\r\n\r\nbody\r\n") {
+		t.Errorf("unexpected mail %q", mail)
+	}
+}
+
+func TestHasPendingCommand(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	s := newSession(New(nil), conn, defaultPolicy)
+	go io.WriteString(client, "NOOP\r\nNOOP\r\nNO")
+	for i, want := range []bool{true, false} {
+		if _, err := s.conn.ReadLine(); err != nil {
+			t.Fatalf("%dth: read: %v", i, err)
+		}
+		if got := s.hasPendingCommand(); got != want {
+			t.Errorf("%dth: pending command want %v, got %v", i, want, got)
+		}
+	}
+}
+
+func TestBdat(t *testing.T) {
+	repo := newTestRepository()
+	c := newTestSession(t, New(repo), &Policy{MaxMessageSize: 10, MaxErrors: 10})
+	c.startMail("")
+	c.write("BDAT 6\r\nHello BDAT 4 LAST\r\nBDAT\r\n")
+	c.expect(CodeOK, CodeOK)
+	if mail := repo.mail("alice@example.com", 0); !strings.HasSuffix(mail, "\r\nHello BDAT") {
+		t.Errorf("unexpected mail %q", mail)
+	}
+
+	// size limit reached by the second chunk, the transaction is reset
+	c.send("MAIL FROM:<sender@example.org>", "RCPT TO:<alice@example.com>")
+	c.expect(CodeOK, CodeOK)
+	c.write("BDAT 6\r\n123456BDAT 6\r\n123456BDAT 1 LAST\r\n1")
+	c.expect(CodeOK, CodePermExceededStorageAllocation, CodePermBadSequenceOfCommands)
+
+	// RSET between chunks
+	c.send("MAIL FROM:<sender@example.org>", "RCPT TO:<alice@example.com>")
+	c.expect(CodeOK, CodeOK)
+	c.write("BDAT 3\r\nabcRSET\r\nBDAT 3 LAST\r\nabc")
+	c.expect(CodeOK, CodeOK, CodePermBadSequenceOfCommands)
+
+	// DATA after BDAT
+	c.send("MAIL FROM:<sender@example.org>", "RCPT TO:<alice@example.com>")
+	c.expect(CodeOK, CodeOK)
+	c.write("BDAT 3\r\nabcDATA\r\n")
+	c.expect(CodeOK, CodePermBadSequenceOfCommands)
+
+	// bad LAST token, the chunk is consumed anyway
+	c.write("BDAT 3 FINAL\r\nabcNOOP\r\n")
+	c.expect(CodeSyntaxErrorInParametersOrArguments, CodeOK)
+
+	if mail := repo.mail("alice@example.com", 1); mail != "" {
+		t.Errorf("unexpected mail %q", mail)
+	}
+}
+
+func TestBdatSizeOverflow(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	s := newSession(New(newTestRepository()), conn, &Policy{MaxMessageSize: 10})
+	s.tos = append(s.tos, &mail.Address{Address: "alice@example.com"})
+	s.rcptParams = append(s.rcptParams, esmtpParams{})
+	s.data.Write([]byte("x"))
+	s.setState(stateChunking)
+	go func() {
+		client.Write(make([]byte, 100))
+		client.Close()
+	}()
+	// the sum of sizes wraps negative
+	if quit := s.onBdat("9223372036854775807"); !quit {
+		t.Fatalf("want quit on EOF of the chunk")
+	}
+	if n := s.data.Len(); n != 0 {
+		t.Errorf("%d bytes spooled over the limit", n)
+	}
+}
+
+func TestBinaryMIMERequiresBdat(t *testing.T) {
+	repo := newTestRepository()
+	c := newTestSession(t, New(repo), &Policy{MaxMessageSize: 1024})
+	c.startMail(" BODY=BINARYMIME")
+	c.send("DATA")
+	c.expect(CodePermBadSequenceOfCommands)
+	c.write("BDAT 5 LAST\r\n\x00\x01\r\n.")
+	c.expect(CodeOK)
+	if mail := repo.mail("alice@example.com", 0); !strings.HasSuffix(mail, "\r\n\x00\x01\r\n.") {
+		t.Errorf("unexpected mail %q", mail)
+	}
+}
+
+func TestLMTP(t *testing.T) {
+	repo := newTestRepository()
+	c := newTestSession(t, New(repo), &Policy{LMTP: true, MaxMessageSize: 1024})
+	c.send("EHLO client.example.org")
+	c.expect(CodePermCommandNotImplemented)
+	c.send("LHLO client.example.org", "MAIL FROM:<sender@example.org>", "RCPT TO:<alice@example.com>",
+		"RCPT TO:<broken@example.com>", "RCPT TO:<bob@example.com>", "DATA")
+	c.expect(CodeOK, CodeOK, CodeOK, CodeOK, CodeOK, CodeStartMailInput)
+	// one reply for each recipient in order
+	c.send("Subject: hi", "", "body", ".")
+	c.expect(CodeOK, 4, CodeOK)
+	for _, to := range []string{"alice@example.com", "bob@example.com"} {
+		if mail := repo.mail(to, 0); !strings.HasSuffix(mail, "body\r\n") {
+			t.Errorf("unexpected mail to %s: %q", to, mail)
+		}
+	}
+}
+
+func TestRcptORcptTooLong(t *testing.T) {
+	c := newTestSession(t, New(newTestRepository()), &Policy{MaxErrors: 10})
+	c.send("EHLO client.example.org", "MAIL FROM:<sender@example.org>",
+		"RCPT TO:<alice@example.com> ORCPT=rfc822;"+strings.Repeat("a", maxORcptLength),
+		"RCPT TO:<alice@example.com> ORCPT=rfc822;alice@example.com")
+	c.expect(CodeOK, CodeOK, CodeSyntaxErrorInParametersOrArguments, CodeOK)
+}
+
+func TestDisabledExtensionCommands(t *testing.T) {
+	if err := loadTestConfig("disabled_extensions: [STARTTLS, AUTH]\n"); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	defer loadTestConfig("")
+	svr := New(newTestRepository())
+	svr.tlsConfig = newTestTLSConfig(t)
+	svr.SetAuthenticator(testAuthenticator{"alice": "secret"})
+	c := newTestSession(t, svr, &Policy{MaxErrors: 10})
+	c.send("EHLO client.example.org", "STARTTLS", "AUTH PLAIN", "NOOP")
+	c.expect(CodeOK, CodePermCommandNotImplemented, CodePermCommandNotImplemented, CodeOK)
+}
+
+func TestMailSize(t *testing.T) {
+	c := newTestSession(t, New(newTestRepository()), &Policy{MaxMessageSize: 10, MaxErrors: 10})
+	c.send("EHLO client.example.org", "MAIL FROM:<sender@example.org> SIZE=11", "MAIL FROM:<sender@example.org> SIZE=10")
+	c.expect(CodeOK, CodePermExceededStorageAllocation, CodeOK)
+
+	// SIZE 0 is advertised if there is no fixed maximum message size
+	repo := newTestRepository()
+	c = newTestSession(t, New(repo), defaultPolicy)
+	c.send("EHLO client.example.org", "MAIL FROM:<sender@example.org> SIZE=100000000",
+		"RCPT TO:<alice@example.com>", "DATA")
+	c.expect(CodeOK, CodeOK, CodeOK, CodeStartMailInput)
+	c.send("Subject: hi", "", "body", ".")
+	c.expect(CodeOK)
+	c.send("MAIL FROM:<sender@example.org>", "RCPT TO:<alice@example.com>")
+	c.expect(CodeOK, CodeOK)
+	c.write("BDAT 4 LAST\r\nbody")
+	c.expect(CodeOK)
+	if mail := repo.mail("alice@example.com", 1); !strings.HasSuffix(mail, "\r\nbody") {
+		t.Errorf("unexpected mail %q", mail)
+	}
+}
+
+func TestTLSRequired(t *testing.T) {
+	svr := New(newTestRepository())
+	svr.tlsConfig = newTestTLSConfig(t)
+	svr.SetAuthenticator(testAuthenticator{"alice": "secret"})
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret"))
+	c := newTestSession(t, svr, &Policy{RequireTLS: TLSBeforeMail, MaxErrors: 10})
+	c.send("EHLO client.example.org", "AUTH PLAIN "+plain, "MAIL FROM:<sender@example.org>", "STARTTLS")
+	c.expect(CodeOK, CodeAuthRequired, CodeAuthRequired, CodeServiceReady)
+	c.startTLS()
+	c.send("EHLO client.example.org", "AUTH PLAIN "+plain, "MAIL FROM:<sender@example.org>")
+	c.expect(CodeOK, CodeAuthSucceeded, CodeOK)
+}
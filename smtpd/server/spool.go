@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// spool holds mail data in memory until its size exceeds threshold,
+// then it switches to a temporary file in dir
+type spool struct {
+	dir       string
+	threshold int
+	buf       bytes.Buffer
+	file      *os.File
+	size      int64
+
+	// err records the first write error
+	err error
+}
+
+func newSpool(dir string, threshold int) *spool {
+	return &spool{dir: dir, threshold: threshold}
+}
+
+func (sp *spool) Write(p []byte) (int, error) {
+	if sp.err != nil {
+		return 0, sp.err
+	}
+	if sp.file == nil && sp.buf.Len()+len(p) > sp.threshold {
+		if sp.err = sp.switchToFile(); sp.err != nil {
+			return 0, sp.err
+		}
+	}
+	var (
+		n   int
+		err error
+	)
+	if sp.file != nil {
+		n, err = sp.file.Write(p)
+	} else {
+		n, err = sp.buf.Write(p)
+	}
+	sp.size += int64(n)
+	sp.err = err
+	return n, err
+}
+
+func (sp *spool) switchToFile() error {
+	file, err := ioutil.TempFile(sp.dir, "smtpd-spool-")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(sp.buf.Bytes()); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	sp.file = file
+	sp.buf.Reset()
+	return nil
+}
+
+// Len returns size of the spooled data
+func (sp *spool) Len() int64 {
+	return sp.size
+}
+
+// Open returns a reader of the spooled data from the beginning,
+// readers returned by Open are independent of each other
+func (sp *spool) Open() io.Reader {
+	if sp.file != nil {
+		return io.NewSectionReader(sp.file, 0, sp.size)
+	}
+	return bytes.NewReader(sp.buf.Bytes())
+}
+
+// Reset discards the spooled data and removes the temporary file
+func (sp *spool) Reset() {
+	sp.buf.Reset()
+	sp.size = 0
+	sp.err = nil
+	if sp.file != nil {
+		sp.file.Close()
+		os.Remove(sp.file.Name())
+		sp.file = nil
+	}
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	sp := newSpool("", 8)
+	sp.Write([]byte("hello"))
+	if sp.file != nil {
+		t.Fatalf("spool should be in memory")
+	}
+	sp.Write([]byte(", world"))
+	if sp.file == nil {
+		t.Fatalf("spool should switch to file")
+	}
+	name := sp.file.Name()
+	for i := 0; i < 2; i++ {
+		data, err := ioutil.ReadAll(sp.Open())
+		if err != nil || string(data) != "hello, world" {
+			t.Fatalf("%dth read: got %q, %v", i, data, err)
+		}
+	}
+	sp.Reset()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("spool file %s not removed", name)
+	}
+	if sp.Len() != 0 {
+		t.Fatalf("spool not reset")
+	}
+}
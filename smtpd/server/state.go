@@ -10,4 +10,5 @@ const (
 	stateExpectCmdMail
 	stateExpectCmdRcpt
 	stateExpectCmdData
+	stateChunking
 )
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/mkideal/cmail/smtpd/etc"
+)
+
+//--------------------------------
+// Message submission (RFC6409)
+//--------------------------------
+
+// checkAuthRequired checks whether AUTH is done before MAIL if required,
+// e.g. on submission listener, nil is returned if satisfied. STARTTLS is
+// required before AUTH and MAIL by dispatch already
+func (s *session) checkAuthRequired() *reply {
+	if !s.policy.authRequired() {
+		return nil
+	}
+	if s.user == nil {
+		return newReply(CodeAuthRequired, EnhSecurityPolicy, "Authentication required")
+	}
+	return nil
+}
+
+// checkSender checks whether the reverse-path belongs to the authenticated
+// mailbox on submission listener (RFC6409 6.1)
+func (s *session) checkSender(from string) *reply {
+	if !s.policy.Submission {
+		return nil
+	}
+	if from == "" || !strings.EqualFold(from, s.user.Address) {
+		return newReplyf(CodePermMailboxNameNotAllowed, EnhNotAuthorized, "sender <%s> not owned by user %s", from, s.user.Address)
+	}
+	return nil
+}
+
+// relayAllowed reports whether mail to a non-local recipient is accepted.
+// By default authenticated users may always relay, others only if their
+// mail comes from local domain or delay is allowed. LMTP is for final
+// delivery only.
+func (s *session) relayAllowed() bool {
+	if s.policy.Relay == RelayNone {
+		return false
+	}
+	if s.user != nil {
+		return true
+	}
+	if s.policy.Submission || s.policy.LMTP || s.policy.Relay == RelayAuthenticated {
+		return false
+	}
+	return etc.Conf().AllowDelay || (s.from != nil && isLocalDomain(parseDomainFromAddress(s.from.Address)))
+}
+
+func isLocalDomain(domain string) bool {
+	return strings.EqualFold(domain, etc.Conf().DomainName)
+}
+
+// mailHeader returns header fields prepended to mail data of current
+// transaction. Received trace field is prepended (RFC5321 4.4), and missing
+// Date and Message-ID header fields are added on submission listener
+// (RFC6409 8.2, 8.3). It's built once, so that every recipient gets the same.
+func (s *session) mailHeader() []byte {
+	now := time.Now()
+	header := s.receivedHeader(now)
+	if !s.policy.Submission {
+		return header
+	}
+	missing, err := missingSubmissionHeaders(s.data.Open(), now)
+	if err != nil {
+		return header
+	}
+	return append(header, missing...)
+}
+
+// mailReader returns reader of mail data to be stored with the header
+func (s *session) mailReader(header []byte) io.Reader {
+	return io.MultiReader(bytes.NewReader(header), s.data.Open())
+}
+
+// missingSubmissionHeaders returns Date and Message-ID header fields
+// which are absent in header section of the message read from r
+func missingSubmissionHeaders(r io.Reader, now time.Time) ([]byte, error) {
+	var (
+		br           = bufio.NewReader(r)
+		hasDate      bool
+		hasMessageID bool
+	)
+	for {
+		line, err := br.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == "" {
+			// end of header section
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			if index := strings.Index(line, ":"); index > 0 {
+				switch strings.ToLower(strings.TrimSpace(line[:index])) {
+				case "date":
+					hasDate = true
+				case "message-id":
+					hasMessageID = true
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	buf := new(bytes.Buffer)
+	if !hasDate {
+		fmt.Fprintf(buf, "Date: %s%s", now.Format(time.RFC1123Z), crlf)
+	}
+	if !hasMessageID {
+		fmt.Fprintf(buf, "Message-ID: <%x.%d@%s>%s", randomBytes(8), now.UnixNano(), etc.Conf().DomainName, crlf)
+	}
+	return buf.Bytes(), nil
+}
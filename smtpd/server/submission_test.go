@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMissingSubmissionHeaders(t *testing.T) {
+	now := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC)
+	for i, tc := range []struct {
+		message         string
+		date, messageID bool
+	}{
+		{"Subject: hi\r\n\r\nbody\r\n", true, true},
+		{"Date: Sun, 01 May 2016 10:00:00 +0000\r\nMessage-Id: <a@b>\r\n\r\nbody\r\n", false, false},
+		{"Subject: hi\r\n  date: folded\r\n\r\nDate: in body\r\n", true, true},
+		{"DATE: Sun, 01 May 2016 10:00:00 +0000\r\nSubject: no body", false, true},
+	} {
+		missing, err := missingSubmissionHeaders(strings.NewReader(tc.message), now)
+		if err != nil {
+			t.Errorf("%dth: unexpected error %v", i, err)
+			continue
+		}
+		if got := strings.Contains(string(missing), "Date: Sun, 01 May 2016 10:00:00 +0000\r\n"); got != tc.date {
+			t.Errorf("%dth: Date added want %v, got %q", i, tc.date, missing)
+		}
+		if got := strings.HasPrefix(string(missing), "Message-ID: <") || strings.Contains(string(missing), "\r\nMessage-ID: <"); got != tc.messageID {
+			t.Errorf("%dth: Message-ID added want %v, got %q", i, tc.messageID, missing)
+		}
+	}
+}
+
+func TestSubmissionHeadersPerTransaction(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	repo := newTestRepository()
+	s := newSession(New(repo), conn, &Policy{Submission: true})
+	s.helo = "client.example.org"
+	for _, name := range []string{"alice", "bob"} {
+		s.tos = append(s.tos, &mail.Address{Name: name, Address: name + "@example.com"})
+		s.rcptParams = append(s.rcptParams, esmtpParams{})
+	}
+	s.data.Write([]byte("Subject: hi\r\n\r\nbody\r\n"))
+	s.complete()
+
+	alice, bob := repo.mail("alice@example.com", 0), repo.mail("bob@example.com", 0)
+	if !strings.Contains(alice, "\r\nMessage-ID: <") || !strings.HasSuffix(alice, "Subject: hi\r\n\r\nbody\r\n") {
+		t.Fatalf("unexpected mail %q", alice)
+	}
+	if alice != bob {
+		t.Errorf("recipients got different copies:\n%q\n%q", alice, bob)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/mkideal/cmail/smtpd/etc"
+	"github.com/mkideal/pkg/debug"
+)
+
+//------------------------------
+// Timeouts (RFC5321 4.5.3.2)
+//------------------------------
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
+// deadline returns the deadline after timeout, zero means no deadline
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+func (s *session) setReadTimeout(timeout time.Duration) {
+	s.nativeConn.SetReadDeadline(deadline(timeout))
+}
+
+// writeDeadline returns deadline of writing pending replies. Reply of mail
+// data must be sent in data termination timeout since it terminated,
+// or client may give up and retry.
+func (s *session) writeDeadline() time.Time {
+	if s.dataTerminated.IsZero() {
+		return deadline(s.commandTimeout())
+	}
+	t := s.dataTerminated
+	s.dataTerminated = time.Time{}
+	if timeout := seconds(etc.Conf().DataTermTimeout); timeout > 0 {
+		return t.Add(timeout)
+	}
+	return time.Time{}
+}
+
+// timeoutReader sets read deadline before each read, first timeout
+// is used for the first read and next timeout for the rest
+type timeoutReader struct {
+	s     *session
+	r     io.Reader
+	first time.Duration
+	next  time.Duration
+	read  bool
+}
+
+func (s *session) newTimeoutReader(r io.Reader, first, next time.Duration) *timeoutReader {
+	return &timeoutReader{s: s, r: r, first: first, next: next}
+}
+
+func (tr *timeoutReader) Read(p []byte) (int, error) {
+	if tr.read {
+		tr.s.setReadTimeout(tr.next)
+	} else {
+		tr.s.setReadTimeout(tr.first)
+		tr.read = true
+	}
+	return tr.r.Read(p)
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// onReadError handles read error of connection, 421 is replied if
+// timed out. Session should quit after that.
+func (s *session) onReadError(err error) {
+	debug.Debugf("session %d read error: %v", s.id, err)
+	if !isTimeout(err) {
+		return
+	}
+	if s.isIdle() && s.svr.shuttingDown() {
+		// interrupted by server
+		s.responseShutdown()
+	} else {
+		s.responseTimeout()
+	}
+}
+
+func (s *session) commandTimeout() time.Duration {
+	return seconds(etc.Conf().CommandTimeout)
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTimeoutReader(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	s := &session{nativeConn: server}
+	r := s.newTimeoutReader(server, time.Second, 10*time.Millisecond)
+	go client.Write([]byte("x"))
+	buf := make([]byte, 1)
+	if n, err := r.Read(buf); n != 1 || err != nil {
+		t.Fatalf("first read: got %d, %v", n, err)
+	}
+	if _, err := r.Read(buf); !isTimeout(err) {
+		t.Errorf("next read: want timeout, got %v", err)
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	s := &session{}
+	if !s.writeDeadline().IsZero() {
+		t.Errorf("no command timeout: want no deadline")
+	}
+	s.dataTerminated = time.Now()
+	s.writeDeadline()
+	if !s.dataTerminated.IsZero() {
+		t.Errorf("want data termination cleared after used")
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mkideal/cmail/smtpd/etc"
+)
+
+//---------------------------
+// Trace fields (RFC5321 4.4)
+//---------------------------
+
+// receivedHeader returns Received trace field of the mail:
+// "Received:" FWS "from" FWS domain FWS "(" TCP-info ")" CFWS
+// "by" FWS domain CFWS "with" FWS protocol CFWS "id" FWS id
+// [CFWS "for" FWS path] ";" FWS date-time
+func (s *session) receivedHeader(now time.Time) []byte {
+	helo := s.helo
+	if helo == "" {
+		helo = "unknown"
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "Received: from %s (%s)%s", helo, clientAddress(s.nativeConn.RemoteAddr()), crlf)
+	fmt.Fprintf(buf, "\tby %s with %s id %d", etc.Conf().DomainName, s.protocol(), s.id)
+	if len(s.tos) == 1 {
+		fmt.Fprintf(buf, "%s\tfor <%s>", crlf, s.tos[0].Address)
+	}
+	fmt.Fprintf(buf, ";%s\t%s%s", crlf, now.Format(time.RFC1123Z), crlf)
+	return buf.Bytes()
+}
+
+// clientAddress returns address literal of the client, which is the real
+// one if accepted from trusted proxy
+func clientAddress(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		if addr == nil || addr.String() == "" {
+			return "local"
+		}
+		return addr.String()
+	}
+	if tcpAddr.IP.To4() != nil {
+		return "[" + tcpAddr.IP.String() + "]"
+	}
+	return "[IPv6:" + tcpAddr.IP.String() + "]"
+}
+
+// protocol returns protocol type of "with" clause (RFC3848)
+func (s *session) protocol() string {
+	protocol := "SMTP"
+	if s.policy.LMTP {
+		protocol = "LMTP"
+	} else if s.extended {
+		protocol = "ESMTP"
+	}
+	if protocol == "SMTP" {
+		return protocol
+	}
+	if s.tls {
+		protocol += "S"
+	}
+	if s.user != nil {
+		protocol += "A"
+	}
+	return protocol
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net"
+	"net/mail"
+	"testing"
+)
+
+func TestClientAddress(t *testing.T) {
+	for addr, want := range map[net.Addr]string{
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}:   "[192.0.2.1]",
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 25}: "[IPv6:2001:db8::1]",
+		&net.UnixAddr{Net: "unix"}:                             "local",
+	} {
+		if got := clientAddress(addr); got != want {
+			t.Errorf("%v: got %s, want %s", addr, got, want)
+		}
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	s := &session{policy: defaultPolicy}
+	if got := s.protocol(); got != "SMTP" {
+		t.Errorf("HELO: got %s", got)
+	}
+	s.extended, s.tls, s.user = true, true, &mail.Address{Address: "alice@example.com"}
+	if got := s.protocol(); got != "ESMTPSA" {
+		t.Errorf("EHLO with TLS and AUTH: got %s", got)
+	}
+	s.policy = &Policy{LMTP: true}
+	s.tls, s.user = false, nil
+	if got := s.protocol(); got != "LMTP" {
+		t.Errorf("LHLO: got %s", got)
+	}
+}
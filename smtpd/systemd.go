@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// first file descriptor passed by socket activation, SD_LISTEN_FDS_START
+const listenFdsStart = 3
+
+// systemdListeners returns listeners passed by systemd socket activation
+// (sd_listen_fds(3)) grouped by names. The environment variables are unset
+// so that they are not inherited by child processes.
+func systemdListeners() (map[string][]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	return fileListeners(n, strings.Split(os.Getenv("LISTEN_FDNAMES"), ":"))
+}
+
+// fileListeners returns listeners of n file descriptors from listenFdsStart
+// grouped by names
+func fileListeners(n int, names []string) (map[string][]net.Listener, error) {
+	listeners := make(map[string][]net.Listener)
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		// FileListener dups the descriptor, the original one is closed
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("fd %d(%s): %v", fd, name, err)
+		}
+		listeners[name] = append(listeners[name], l)
+	}
+	return listeners, nil
+}
+
+func closeListeners(listeners map[string][]net.Listener) {
+	for _, ls := range listeners {
+		for _, l := range ls {
+			l.Close()
+		}
+	}
+}
+
+// sdNotify sends state to the service manager (sd_notify(3)), nothing is
+// done if not started by systemd
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	if name[0] == '@' {
+		// abstract namespace
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestHelperListeners runs in child process started by runListenersHelper,
+// it prints names and addresses of the listeners passed to it
+func TestHelperListeners(t *testing.T) {
+	var (
+		listeners map[string][]net.Listener
+		err       error
+	)
+	switch os.Getenv("SMTPD_TEST_HELPER") {
+	case "systemd":
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		listeners, err = systemdListeners()
+	case "inherited":
+		listeners, err = inheritedListeners()
+	default:
+		return
+	}
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		os.Exit(1)
+	}
+	for name, ls := range listeners {
+		for _, l := range ls {
+			fmt.Printf("%s %s\n", name, l.Addr())
+		}
+	}
+	for _, env := range []string{"LISTEN_FDS", "LISTEN_FDNAMES", envInheritedFds, envInheritedFdNames} {
+		if os.Getenv(env) != "" {
+			fmt.Printf("%s not unset\n", env)
+		}
+	}
+	os.Exit(0)
+}
+
+// runListenersHelper passes listeners from listenFdsStart to a child
+// process, and returns sorted lines printed by it
+func runListenersHelper(t *testing.T, mode string, env []string, listeners ...net.Listener) []string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperListeners$")
+	cmd.Env = append(append(os.Environ(), "SMTPD_TEST_HELPER="+mode), env...)
+	for _, l := range listeners {
+		f, err := l.(interface {
+			File() (*os.File, error)
+		}).File()
+		if err != nil {
+			t.Fatalf("listener file: %v", err)
+		}
+		defer f.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("helper: %v\n%s", err, out)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+// testListeners returns two TCP listeners and a unix one
+func testListeners(t *testing.T) (listeners []net.Listener, cleanup func()) {
+	dir, err := ioutil.TempDir("", "smtpd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup = func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+		os.RemoveAll(dir)
+	}
+	for _, addr := range []string{"127.0.0.1:0", "127.0.0.1:0", filepath.Join(dir, "smtpd.sock")} {
+		network := "tcp"
+		if !strings.HasPrefix(addr, "127.") {
+			network = "unix"
+		}
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			cleanup()
+			t.Skipf("listen: %v", err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, cleanup
+}
+
+func TestSystemdListeners(t *testing.T) {
+	listeners, cleanup := testListeners(t)
+	defer cleanup()
+	got := runListenersHelper(t, "systemd", []string{"LISTEN_FDS=3", "LISTEN_FDNAMES=smtp:smtp:"}, listeners...)
+	want := []string{
+		"smtp " + listeners[0].Addr().String(),
+		"smtp " + listeners[1].Addr().String(),
+		"unknown " + listeners[2].Addr().String(),
+	}
+	sort.Strings(want)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}